@@ -0,0 +1,111 @@
+package check
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bmeg/lathe/logger"
+	"github.com/bmeg/lathe/scriptfile"
+	"github.com/bmeg/lathe/util"
+	"github.com/bmeg/lathe/workflow"
+	"github.com/spf13/cobra"
+)
+
+var outJson = false
+var verbose = false
+var paramList = []string{}
+var paramsFile = ""
+
+// Cmd is the declaration of the command line
+var Cmd = &cobra.Command{
+	Use:   "check <plan file> [workflow]",
+	Short: "Validate a plan file without running it",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		scriptPath, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+
+		logger.Init(verbose, false)
+
+		params, err := scriptfile.ParseParams(paramsFile, paramList)
+		if err != nil {
+			return err
+		}
+		workflows, err := scriptfile.RunFile(scriptPath, params)
+		if err != nil {
+			return &util.ExitError{Code: util.EXIT_PLAN_ERROR, Err: err}
+		}
+
+		names := []string{}
+		if len(args) > 1 {
+			names = args[1:]
+		} else {
+			for k := range workflows.Workflows {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+		}
+
+		errCount := 0
+		warnCount := 0
+		for _, n := range names {
+			wfd, ok := workflows.Workflows[n]
+			if !ok {
+				return &util.ExitError{Code: util.EXIT_PLAN_ERROR, Err: fmt.Errorf("workflow %s not found", n)}
+			}
+			for _, i := range workflow.Check(wfd) {
+				if i.Level == workflow.ISSUE_ERROR {
+					errCount++
+				} else {
+					warnCount++
+				}
+				if outJson {
+					data := map[string]any{
+						"workflow": n,
+						"level":    i.Level,
+						"step":     i.Step,
+						"source":   i.Source,
+						"message":  i.Message,
+					}
+					b, err := json.Marshal(data)
+					if err == nil {
+						fmt.Printf("%s\n", b)
+					}
+				} else {
+					where := []string{}
+					if i.Source != "" {
+						where = append(where, i.Source)
+					}
+					if i.Step != "" {
+						where = append(where, "step "+i.Step)
+					}
+					if len(where) > 0 {
+						fmt.Printf("%s: %s: %s\n", strings.Join(where, ": "), i.Level, i.Message)
+					} else {
+						fmt.Printf("%s: %s: %s\n", n, i.Level, i.Message)
+					}
+				}
+			}
+		}
+		if !outJson {
+			fmt.Printf("%d errors, %d warnings\n", errCount, warnCount)
+		}
+		if errCount > 0 {
+			return &util.ExitError{Code: util.EXIT_PLAN_ERROR, Err: fmt.Errorf("plan has %d errors", errCount)}
+		}
+		return nil
+	},
+}
+
+func init() {
+	flags := Cmd.Flags()
+	flags.BoolVarP(&outJson, "json", "j", outJson, "Output JSON")
+	flags.BoolVarP(&verbose, "verbose", "v", verbose, "Vebose logging")
+	flags.StringArrayVar(&paramList, "param", paramList, "Plan parameter as key=value, may be repeated")
+	flags.StringVar(&paramsFile, "params-file", paramsFile, "YAML or JSON file of plan parameters")
+}
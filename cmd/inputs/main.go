@@ -11,6 +11,8 @@ import (
 )
 
 var outJson = false
+var paramList = []string{}
+var paramsFile = ""
 
 // Cmd is the declaration of the command line
 var Cmd = &cobra.Command{
@@ -51,7 +53,11 @@ var List = &cobra.Command{
 		wfName := args[1]
 		//dstBase := args[1]
 		logger.Info("doing list")
-		workflows, err := scriptfile.RunFile(scriptPath)
+		params, err := scriptfile.ParseParams(paramsFile, paramList)
+		if err != nil {
+			return err
+		}
+		workflows, err := scriptfile.RunFile(scriptPath, params)
 		if err != nil {
 			logger.Info("Script Error", "error", err)
 			return err
@@ -97,4 +103,6 @@ func init() {
 
 	listFlags := List.Flags()
 	listFlags.BoolVarP(&outJson, "json", "j", outJson, "Output JSON")
+	listFlags.StringArrayVar(&paramList, "param", paramList, "Plan parameter as key=value, may be repeated")
+	listFlags.StringVar(&paramsFile, "params-file", paramsFile, "YAML or JSON file of plan parameters")
 }
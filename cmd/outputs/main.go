@@ -12,6 +12,8 @@ import (
 )
 
 var outJson = false
+var paramList = []string{}
+var paramsFile = ""
 var verbose = false
 var jsonLog = false
 var relPath = "./"
@@ -58,7 +60,11 @@ var List = &cobra.Command{
 		logger.Init(verbose, jsonLog)
 
 		logger.Info("doing list")
-		workflows, err := scriptfile.RunFile(scriptPath)
+		params, err := scriptfile.ParseParams(paramsFile, paramList)
+		if err != nil {
+			return err
+		}
+		workflows, err := scriptfile.RunFile(scriptPath, params)
 		if err != nil {
 			logger.Info("Script Error", "error", err)
 			return err
@@ -119,6 +125,8 @@ func init() {
 
 	listFlags := List.Flags()
 	listFlags.BoolVarP(&outJson, "json", "j", outJson, "Output JSON")
+	listFlags.StringArrayVar(&paramList, "param", paramList, "Plan parameter as key=value, may be repeated")
+	listFlags.StringVar(&paramsFile, "params-file", paramsFile, "YAML or JSON file of plan parameters")
 	listFlags.BoolVarP(&verbose, "verbose", "v", verbose, "Vebose logging")
 
 }
@@ -3,10 +3,12 @@ package cmd
 import (
 	"os"
 
+	"github.com/bmeg/lathe/cmd/check"
 	"github.com/bmeg/lathe/cmd/inputs"
 	"github.com/bmeg/lathe/cmd/outputs"
 	"github.com/bmeg/lathe/cmd/prep_upload"
 	"github.com/bmeg/lathe/cmd/run"
+	"github.com/bmeg/lathe/cmd/status"
 	"github.com/bmeg/lathe/cmd/viz"
 
 	"github.com/spf13/cobra"
@@ -20,10 +22,12 @@ var RootCmd = &cobra.Command{
 }
 
 func init() {
+	RootCmd.AddCommand(check.Cmd)
 	RootCmd.AddCommand(prep_upload.Cmd)
 	RootCmd.AddCommand(inputs.Cmd)
 	RootCmd.AddCommand(outputs.Cmd)
 	RootCmd.AddCommand(run.Cmd)
+	RootCmd.AddCommand(status.Cmd)
 	RootCmd.AddCommand(viz.Cmd)
 }
 
@@ -1,12 +1,20 @@
 package run
 
 import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/bmeg/lathe/logger"
 	"github.com/bmeg/lathe/runner"
 	"github.com/bmeg/lathe/scriptfile"
+	"github.com/bmeg/lathe/state"
+	"github.com/bmeg/lathe/util"
 	"github.com/bmeg/lathe/workflow"
 	"github.com/spf13/cobra"
 )
@@ -14,7 +22,21 @@ import (
 var verbose = false
 var jsonLog = false
 var dryRun bool = false
+var explain = false
 var tesServer = ""
+var checkMode = workflow.CHECK_HASH
+var stepTimeout time.Duration
+var quarantine = false
+var failFast = false
+var atomic = false
+var keepGoing = false
+var targets = []string{}
+var force = []string{}
+var forceDownstream = false
+var fromStep = ""
+var untilStep = ""
+var paramList = []string{}
+var paramsFile = ""
 
 // Cmd is the declaration of the command line
 var Cmd = &cobra.Command{
@@ -29,16 +51,68 @@ var Cmd = &cobra.Command{
 
 		logger.Init(verbose, jsonLog)
 
+		if failFast && keepGoing {
+			return fmt.Errorf("--fail-fast and --keep-going can not be used together")
+		}
+
+		if explain && !dryRun {
+			return fmt.Errorf("--explain can only be used with --dry-run")
+		}
+
+		if checkMode != workflow.CHECK_HASH && checkMode != workflow.CHECK_MTIME {
+			return fmt.Errorf("unknown check mode '%s', options: %s, %s", checkMode, workflow.CHECK_HASH, workflow.CHECK_MTIME)
+		}
+
 		//baseDir := filepath.Dir(scriptPath)
 		names := []string{}
 		if len(args) > 1 {
 			names = args[1:]
 		}
-		workflows, err := scriptfile.RunFile(scriptPath)
+		params, err := scriptfile.ParseParams(paramsFile, paramList)
+		if err != nil {
+			return err
+		}
+		workflows, err := scriptfile.RunFile(scriptPath, params)
+		if err != nil {
+			logger.Error("Script Error", "path", scriptPath, "error", err)
+			return &util.ExitError{Code: util.EXIT_PLAN_ERROR, Err: err}
+		}
+
+		//a dry run only reads the state, so it works while another run holds it
+		openState := state.Open
+		if dryRun {
+			openState = state.OpenReadOnly
+		}
+		store, err := openState(filepath.Join(state.LatheDir(scriptPath), "state"))
 		if err != nil {
-			logger.Error("Script Error %s : %s\n", scriptPath, err)
+			logger.Error("State database error", "error", err)
 			return err
 		}
+		defer store.Close()
+
+		runID := time.Now().Format("20060102-150405")
+		logDir := filepath.Join(state.LatheDir(scriptPath), "logs", runID)
+		logger.Info("Run started", "id", runID, "logs", logDir)
+		quarantineDir := ""
+		if quarantine {
+			quarantineDir = filepath.Join(state.LatheDir(scriptPath), "quarantine", runID)
+		}
+
+		//On the first SIGINT or SIGTERM, stop scheduling steps and terminate the
+		//running ones. A second signal exits immediately
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(sigs)
+		go func() {
+			if sig, ok := <-sigs; ok {
+				signal.Stop(sigs)
+				logger.Error("Received signal, stopping workflow", "signal", sig)
+				logger.AddSummaryError("Run interrupted", "signal", sig.String())
+				cancel()
+			}
+		}()
 
 		var run runner.CommandRunner
 		if tesServer == "" {
@@ -55,18 +129,93 @@ var Cmd = &cobra.Command{
 				names = wNames
 			} else {
 				logger.Error("Need to choose a workflow", "options", strings.Join(wNames, ", "))
-				return nil
+				return &util.ExitError{Code: util.EXIT_PLAN_ERROR, Err: fmt.Errorf("need to choose a workflow: %s", strings.Join(wNames, ", "))}
+			}
+		}
+
+		exitCode := util.EXIT_OK
+		setExit := func(code int) {
+			//keep the most serious outcome: plan errors, then interruption, step failures and missing inputs
+			for _, c := range []int{util.EXIT_PLAN_ERROR, util.EXIT_INTERRUPTED, util.EXIT_STEP_FAILED, util.EXIT_MISSING_INPUT} {
+				if exitCode == c {
+					return
+				}
+				if code == c {
+					exitCode = code
+					return
+				}
 			}
 		}
 
 		for _, n := range names {
+			if ctx.Err() != nil {
+				break
+			}
 			if wfd, ok := workflows.Workflows[n]; ok {
 				wf, err := workflow.PrepWorkflow(wfd, run)
-				if err == nil {
+				if err != nil {
+					logger.Error("Workflow error", "name", n, "error", err)
+					logger.AddSummaryError("Workflow error", "name", n, "error", err)
+					setExit(util.EXIT_PLAN_ERROR)
+				} else {
+					wf.State = store
+					wf.CheckMode = checkMode
+					wf.LogDir = logDir
+					wf.StepTimeout = stepTimeout
+					wf.QuarantineDir = quarantineDir
+					wf.FailFast = failFast
+					wf.AtomicOutputs = atomic
+					//select the steps to run first, so forcing only applies to those
+					if len(targets) > 0 {
+						steps, err := wf.TargetSteps(targets)
+						if err != nil {
+							logger.Error("Target error", "name", n, "error", err)
+							logger.AddSummaryError("Target error", "name", n, "error", err)
+							setExit(util.EXIT_PLAN_ERROR)
+							continue
+						}
+						wf.Prune(steps)
+					}
+					if untilStep != "" {
+						if err := wf.RunUntil(untilStep); err != nil {
+							logger.Error("Until error", "name", n, "error", err)
+							logger.AddSummaryError("Until error", "name", n, "error", err)
+							setExit(util.EXIT_PLAN_ERROR)
+							continue
+						}
+					}
+					if fromStep != "" {
+						if err := wf.RunFrom(fromStep); err != nil {
+							logger.Error("From error", "name", n, "error", err)
+							logger.AddSummaryError("From error", "name", n, "error", err)
+							setExit(util.EXIT_PLAN_ERROR)
+							continue
+						}
+					}
+					if len(force) > 0 {
+						if err := wf.ForceSteps(force, forceDownstream); err != nil {
+							logger.Error("Force error", "name", n, "error", err)
+							logger.AddSummaryError("Force error", "name", n, "error", err)
+							setExit(util.EXIT_PLAN_ERROR)
+							continue
+						}
+					}
+					if explain {
+						fmt.Printf("Workflow %s:\n", n)
+						if err := wf.Explain(os.Stdout); err != nil {
+							logger.Error("Workflow build error", "name", n, "error", err)
+							logger.AddSummaryError("Workflow build error", "name", n, "error", err)
+							setExit(util.EXIT_PLAN_ERROR)
+						}
+						continue
+					}
 					//fmt.Printf("Running Workflow: %#v\n", wf)
-					fwf, err := wf.BuildFlame()
+					fwf, err := wf.BuildFlame(ctx)
 					if err != nil {
-						logger.Error("workflow build error: %s\n", err)
+						logger.Error("Workflow build error", "name", n, "error", err)
+						logger.AddSummaryError("Workflow build error", "name", n, "error", err)
+						setExit(util.EXIT_PLAN_ERROR)
+						continue
 					}
 					//fmt.Printf("%#v\n", fwf)
 
@@ -84,24 +233,61 @@ var Cmd = &cobra.Command{
 					*/
 					fwf.Workflow.Start()
 					fwf.Workflow.Wait()
+					wf.CleanStaging()
 
 					logger.Info("Workflow Done")
+					wf.AddSummary(n)
+					if wf.Counts()[workflow.OUTCOME_FAILED] > 0 {
+						setExit(util.EXIT_STEP_FAILED)
+					}
+					if len(wf.Report.MissingInputs) > 0 {
+						setExit(util.EXIT_MISSING_INPUT)
+					}
 				}
 			} else {
 				logger.Error("Workflow not found", "name", n)
+				logger.AddSummaryError("Workflow not found", "name", n)
+				setExit(util.EXIT_PLAN_ERROR)
 			}
 		}
+		if ctx.Err() != nil {
+			setExit(util.EXIT_INTERRUPTED)
+		}
 
 		logger.Close()
 
-		return nil
+		switch exitCode {
+		case util.EXIT_OK:
+			return nil
+		case util.EXIT_PLAN_ERROR:
+			return &util.ExitError{Code: exitCode, Err: fmt.Errorf("plan error")}
+		case util.EXIT_INTERRUPTED:
+			return &util.ExitError{Code: exitCode, Err: fmt.Errorf("run interrupted")}
+		case util.EXIT_STEP_FAILED:
+			return &util.ExitError{Code: exitCode, Err: fmt.Errorf("steps failed")}
+		}
+		return &util.ExitError{Code: exitCode, Err: fmt.Errorf("missing inputs")}
 	},
 }
 
 func init() {
 	flags := Cmd.Flags()
 	flags.BoolVarP(&dryRun, "dry-run", "x", dryRun, "Scan workflow without running commands")
+	flags.BoolVar(&explain, "explain", explain, "With --dry-run, print the plan with the reason each step would or would not run")
 	flags.StringVarP(&tesServer, "tes", "t", tesServer, "TES Server")
+	flags.StringVar(&checkMode, "check", checkMode, "Up-to-date check: 'hash' compares content hashes, 'mtime' compares modification times")
 	flags.BoolVarP(&jsonLog, "jsonlog", "j", jsonLog, "JSON logging output")
 	flags.BoolVarP(&verbose, "verbose", "v", verbose, "Vebose logging")
+	flags.StringArrayVar(&targets, "target", targets, "Only build the steps needed to produce this path, may be repeated")
+	flags.StringArrayVar(&force, "force", force, "Rerun the steps matching this name or glob, may be repeated")
+	flags.BoolVar(&forceDownstream, "force-downstream", forceDownstream, "Also rerun every step downstream of the forced steps")
+	flags.StringVar(&fromStep, "from", fromStep, "Rerun this step and everything after it, treating upstream steps with existing outputs as up to date")
+	flags.StringVar(&untilStep, "until", untilStep, "Stop after this step, skipping everything that does not lead to it")
+	flags.BoolVar(&failFast, "fail-fast", failFast, "Cancel all outstanding work after the first failed step")
+	flags.BoolVar(&keepGoing, "keep-going", keepGoing, "Keep running independent steps after a failure (default)")
+	flags.BoolVar(&atomic, "atomic", atomic, "Write the outputs of every step to a staging directory and move them into place once the step succeeds")
+	flags.BoolVar(&quarantine, "quarantine", quarantine, "Move partial outputs of failed or interrupted steps to .lathe/quarantine instead of deleting them")
+	flags.DurationVar(&stepTimeout, "step-timeout", stepTimeout, "Default timeout for steps that do not set one, e.g. 2h")
+	flags.StringArrayVar(&paramList, "param", paramList, "Plan parameter as key=value, may be repeated")
+	flags.StringVar(&paramsFile, "params-file", paramsFile, "YAML or JSON file of plan parameters")
 }
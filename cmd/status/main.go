@@ -0,0 +1,115 @@
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/bmeg/lathe/logger"
+	"github.com/bmeg/lathe/scriptfile"
+	"github.com/bmeg/lathe/state"
+	"github.com/bmeg/lathe/workflow"
+	"github.com/spf13/cobra"
+)
+
+var outJson = false
+var verbose = false
+var checkMode = workflow.CHECK_HASH
+var paramList = []string{}
+var paramsFile = ""
+
+// Cmd is the declaration of the command line
+var Cmd = &cobra.Command{
+	Use:   "status <plan file> [workflow]",
+	Short: "Report which steps are up to date, stale or blocked",
+	Args:  cobra.RangeArgs(1, 2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		scriptPath, err := filepath.Abs(args[0])
+		if err != nil {
+			return err
+		}
+
+		logger.Init(verbose, false)
+
+		if checkMode != workflow.CHECK_HASH && checkMode != workflow.CHECK_MTIME {
+			return fmt.Errorf("unknown check mode '%s', options: %s, %s", checkMode, workflow.CHECK_HASH, workflow.CHECK_MTIME)
+		}
+
+		params, err := scriptfile.ParseParams(paramsFile, paramList)
+		if err != nil {
+			return err
+		}
+		workflows, err := scriptfile.RunFile(scriptPath, params)
+		if err != nil {
+			return err
+		}
+
+		names := []string{}
+		if len(args) > 1 {
+			names = args[1:]
+		} else {
+			for k := range workflows.Workflows {
+				names = append(names, k)
+			}
+			sort.Strings(names)
+		}
+
+		store, err := state.OpenReadOnly(filepath.Join(state.LatheDir(scriptPath), "state"))
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		if !outJson {
+			fmt.Fprintf(tw, "WORKFLOW\tSTEP\tSTATE\tSOURCE\tREASON\n")
+		}
+		for _, n := range names {
+			wfd, ok := workflows.Workflows[n]
+			if !ok {
+				return fmt.Errorf("workflow %s not found, options: %s", n, strings.Join(names, ", "))
+			}
+			wf, err := workflow.PrepWorkflow(wfd, nil)
+			if err != nil {
+				return err
+			}
+			wf.State = store
+			wf.CheckMode = checkMode
+			states, err := wf.Status()
+			if err != nil {
+				return err
+			}
+			for _, s := range states {
+				if outJson {
+					data := map[string]any{
+						"workflow": n,
+						"step":     s.Name,
+						"state":    s.State,
+						"reason":   s.Reason,
+						"source":   s.Source,
+					}
+					b, err := json.Marshal(data)
+					if err == nil {
+						fmt.Printf("%s\n", b)
+					}
+				} else {
+					fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", n, s.Name, s.State, filepath.Base(s.Source), s.Reason)
+				}
+			}
+		}
+		return tw.Flush()
+	},
+}
+
+func init() {
+	flags := Cmd.Flags()
+	flags.BoolVarP(&outJson, "json", "j", outJson, "Output JSON")
+	flags.BoolVarP(&verbose, "verbose", "v", verbose, "Vebose logging")
+	flags.StringVar(&checkMode, "check", checkMode, "Up-to-date check: 'hash' compares content hashes, 'mtime' compares modification times")
+	flags.StringArrayVar(&paramList, "param", paramList, "Plan parameter as key=value, may be repeated")
+	flags.StringVar(&paramsFile, "params-file", paramsFile, "YAML or JSON file of plan parameters")
+}
@@ -3,12 +3,17 @@ package viz
 import (
 	"fmt"
 	"log"
+	"sort"
 
 	"github.com/bmeg/lathe/scriptfile"
 	"github.com/bmeg/lathe/workflow"
 	"github.com/spf13/cobra"
 )
 
+var collapse = false
+var paramList = []string{}
+var paramsFile = ""
+
 var Cmd = &cobra.Command{
 	Use:   "viz",
 	Short: "Draw graph of workflows",
@@ -18,27 +23,84 @@ var Cmd = &cobra.Command{
 		//dstBase := args[1]
 		log.Printf("doing viz: %s\n", scriptPath)
 
-		wfs, err := scriptfile.RunFile(scriptPath)
+		params, err := scriptfile.ParseParams(paramsFile, paramList)
+		if err != nil {
+			return err
+		}
+		wfs, err := scriptfile.RunFile(scriptPath, params)
 		if err != nil {
 			return err
 		}
 
 		for wfn, wfd := range wfs.Workflows {
 			fmt.Printf("digraph %s {\n", wfn)
+			if wfd.Source != "" {
+				fmt.Printf("\ttooltip=%q\n", wfd.Source)
+			}
 			wf, err := workflow.PrepWorkflow(wfd, nil)
 			if err == nil {
+				groups := wf.Groups()
+				groupNames := []string{}
+				for g := range groups {
+					groupNames = append(groupNames, g)
+				}
+				sort.Strings(groupNames)
+
 				nameMap := map[string]string{}
 				for n := range wf.Steps {
 					nameMap[n] = fmt.Sprintf("%d", len(nameMap))
 				}
+				grouped := map[string]bool{}
+				for i, g := range groupNames {
+					for _, n := range groups[g] {
+						grouped[n] = true
+						if collapse {
+							nameMap[n] = fmt.Sprintf("g%d", i)
+						}
+					}
+				}
 
+				printNode := func(indent string, n string, s workflow.WorkflowStep) {
+					if src := s.GetSource(); src != "" {
+						fmt.Printf("%s%s [label=\"%s\" tooltip=%q]\n", indent, nameMap[n], s.GetDesc(), src)
+					} else {
+						fmt.Printf("%s%s [label=\"%s\"]\n", indent, nameMap[n], s.GetDesc())
+					}
+				}
 				for n, s := range wf.Steps {
-					fmt.Printf("\t%s [label=\"%s\"]\n", nameMap[n], s.GetDesc())
+					if !grouped[n] {
+						printNode("\t", n, s)
+					}
+				}
+				for i, g := range groupNames {
+					if collapse {
+						fmt.Printf("\tg%d [label=\"scatter: %s (%d steps)\" shape=box3d]\n", i, g, len(groups[g]))
+					} else {
+						fmt.Printf("\tsubgraph cluster_%d {\n\t\tlabel=%q\n", i, g)
+						for _, n := range groups[g] {
+							printNode("\t\t", n, wf.Steps[n])
+						}
+						fmt.Printf("\t}\n")
+					}
 				}
 
+				edges := map[string]bool{}
 				for n, s := range wf.DepMap {
+					after := map[string]bool{}
+					for _, d := range wf.AfterMap[n] {
+						after[d] = true
+					}
 					for _, d := range s {
-						fmt.Printf("\t%s -> %s\n", nameMap[d], nameMap[n])
+						edge := fmt.Sprintf("%s -> %s", nameMap[d], nameMap[n])
+						if nameMap[d] == nameMap[n] || edges[edge] {
+							continue
+						}
+						edges[edge] = true
+						if after[d] {
+							fmt.Printf("\t%s [style=dashed]\n", edge)
+						} else {
+							fmt.Printf("\t%s\n", edge)
+						}
 					}
 				}
 
@@ -49,3 +111,10 @@ var Cmd = &cobra.Command{
 		return nil
 	},
 }
+
+func init() {
+	flags := Cmd.Flags()
+	flags.BoolVar(&collapse, "collapse", collapse, "Draw each Scatter group as a single node")
+	flags.StringArrayVar(&paramList, "param", paramList, "Plan parameter as key=value, may be repeated")
+	flags.StringVar(&paramsFile, "params-file", paramsFile, "YAML or JSON file of plan parameters")
+}
@@ -1,9 +1,11 @@
 package logger
 
 import (
+	"bufio"
 	"context"
 	"log/slog"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/lmittmann/tint"
@@ -43,27 +45,79 @@ func Error(msg string, args ...any) {
 }
 
 type summaryStatement struct {
-	level slog.Level
-	msg   string
-	args  []any
+	level   slog.Level
+	msg     string
+	args    []any
+	logPath string
 }
 
 var summary = []summaryStatement{}
+var summaryMutex sync.Mutex
+
+func addSummary(s summaryStatement) {
+	summaryMutex.Lock()
+	defer summaryMutex.Unlock()
+	summary = append(summary, s)
+}
+
+// SummaryTailLines is the number of lines of a log file printed with a
+// summary error
+var SummaryTailLines = 20
 
 func AddSummaryError(msg string, args ...any) {
-	summary = append(summary, summaryStatement{slog.LevelError, msg, args})
+	addSummary(summaryStatement{slog.LevelError, msg, args, ""})
+}
+
+func AddSummaryInfo(msg string, args ...any) {
+	addSummary(summaryStatement{slog.LevelInfo, msg, args, ""})
+}
+
+func AddSummaryWarning(msg string, args ...any) {
+	addSummary(summaryStatement{slog.LevelWarn, msg, args, ""})
+}
+
+// AddSummaryErrorLog adds a summary error that is followed by the last
+// SummaryTailLines lines of the log file at logPath
+func AddSummaryErrorLog(msg string, logPath string, args ...any) {
+	addSummary(summaryStatement{slog.LevelError, msg, args, logPath})
 }
 
 func Close() {
 	line := []byte("------------\n")
 
+	summaryMutex.Lock()
+	defer summaryMutex.Unlock()
 	os.Stderr.Write(line)
 	for _, i := range summary {
 		logger.Log(context.TODO(), i.level, i.msg, i.args...)
+		if i.logPath != "" {
+			for _, l := range tail(i.logPath, SummaryTailLines) {
+				os.Stderr.Write([]byte("    " + l + "\n"))
+			}
+		}
 	}
 	os.Stderr.Write(line)
 }
 
+// tail returns the last n lines of a file
+func tail(path string, n int) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	out := []string{}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		out = append(out, scanner.Text())
+		if len(out) > n {
+			out = out[1:]
+		}
+	}
+	return out
+}
+
 func init() {
 	Init(false, false)
 }
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 
 	"github.com/bmeg/lathe/cmd"
+	"github.com/bmeg/lathe/util"
 )
 
 func main() {
@@ -17,6 +19,10 @@ func main() {
 
 	if err := cmd.RootCmd.Execute(); err != nil {
 		fmt.Println("Error:", err.Error())
-		os.Exit(1)
+		var exitErr *util.ExitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.Code)
+		}
+		os.Exit(util.EXIT_ERROR)
 	}
 }
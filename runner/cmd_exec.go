@@ -1,11 +1,19 @@
 package runner
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
 	"os/exec"
 	"os/user"
 	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/bmeg/lathe/logger"
 )
@@ -17,6 +25,11 @@ func (e Error) Error() string {
 }
 
 var PoolErrorNotAvailable = Error("not avalible")
+var CommandErrorTimeout = Error("timed out")
+var CommandErrorCanceled = Error("canceled")
+
+// killGracePeriod is how long a terminated command has to exit before it is killed
+var killGracePeriod = 10 * time.Second
 
 type CommandLineTool struct {
 	CommandLine []string
@@ -26,13 +39,145 @@ type CommandLineTool struct {
 	NCpus       uint
 	MemMB       uint
 	Image       string
+	// LogPrefix is the path prefix of the files stdout and stderr are written
+	// to, as <LogPrefix>.out and <LogPrefix>.err. If empty, output is discarded
+	LogPrefix string
+	// Stdin, Stdout and Stderr are paths, relative to BaseDir, the command's
+	// standard streams are redirected from and to. Redirected output streams
+	// are not written to the log files
+	Stdin  string
+	Stdout string
+	Stderr string
+	// Timeout is the maximum wall time of the command, no limit if zero
+	Timeout time.Duration
 }
 
+// CommandLog records the outcome of running a command. Attempt is set by the
+// caller when a command is retried
 type CommandLog struct {
+	Attempt    int
+	ExitCode   int
+	StartTime  time.Time
+	EndTime    time.Time
+	WallTime   time.Duration
+	StdoutPath string
+	StderrPath string
+	TimedOut   bool
+	Canceled   bool
+}
+
+// start marks the start time of the command
+func (cl *CommandLog) start() {
+	cl.StartTime = time.Now()
+}
+
+// finish marks the end time of the command, and records the exit code from
+// the error returned by running it
+func (cl *CommandLog) finish(err error) {
+	cl.EndTime = time.Now()
+	cl.WallTime = cl.EndTime.Sub(cl.StartTime)
+	var exitErr *exec.ExitError
+	if err == nil {
+		cl.ExitCode = 0
+	} else if errors.As(err, &exitErr) {
+		cl.ExitCode = exitErr.ExitCode()
+	} else {
+		cl.ExitCode = -1
+	}
+}
+
+// openLogs creates the stdout and stderr log files for a command. The returned
+// writers discard output when no LogPrefix is set, or the stream is redirected
+func openLogs(cmdTool *CommandLineTool, cmdLog *CommandLog) (io.WriteCloser, io.WriteCloser, error) {
+	var stdout io.WriteCloser = nopCloser{io.Discard}
+	var stderr io.WriteCloser = nopCloser{io.Discard}
+	if cmdTool.Stdout != "" {
+		cmdLog.StdoutPath = resolvePath(cmdTool.BaseDir, cmdTool.Stdout)
+	}
+	if cmdTool.Stderr != "" {
+		cmdLog.StderrPath = resolvePath(cmdTool.BaseDir, cmdTool.Stderr)
+	}
+	if cmdTool.LogPrefix == "" {
+		return stdout, stderr, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(cmdTool.LogPrefix), 0755); err != nil {
+		return nil, nil, err
+	}
+	var err error
+	if cmdTool.Stdout == "" {
+		cmdLog.StdoutPath = cmdTool.LogPrefix + ".out"
+		if stdout, err = os.Create(cmdLog.StdoutPath); err != nil {
+			return nil, nil, err
+		}
+	}
+	if cmdTool.Stderr == "" {
+		cmdLog.StderrPath = cmdTool.LogPrefix + ".err"
+		if stderr, err = os.Create(cmdLog.StderrPath); err != nil {
+			stdout.Close()
+			return nil, nil, err
+		}
+	}
+	return stdout, stderr, nil
+}
+
+// openStdio opens the standard streams of a command run on this machine: the
+// files they are redirected to, or the log files for unredirected output
+func openStdio(cmdTool *CommandLineTool, cmdLog *CommandLog) (io.ReadCloser, io.WriteCloser, io.WriteCloser, error) {
+	stdout, stderr, err := openLogs(cmdTool, cmdLog)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	closeAll := func() {
+		stdout.Close()
+		stderr.Close()
+	}
+	if cmdTool.Stdout != "" {
+		if stdout, err = createFile(cmdLog.StdoutPath); err != nil {
+			closeAll()
+			return nil, nil, nil, err
+		}
+	}
+	if cmdTool.Stderr != "" {
+		if stderr, err = createFile(cmdLog.StderrPath); err != nil {
+			closeAll()
+			return nil, nil, nil, err
+		}
+	}
+	var stdin io.ReadCloser
+	if cmdTool.Stdin != "" {
+		if stdin, err = os.Open(resolvePath(cmdTool.BaseDir, cmdTool.Stdin)); err != nil {
+			closeAll()
+			return nil, nil, nil, err
+		}
+	}
+	return stdin, stdout, stderr, nil
+}
+
+func createFile(path string) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	return os.Create(path)
+}
+
+func resolvePath(baseDir string, path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	p, _ := filepath.Abs(filepath.Join(baseDir, path))
+	return p
+}
+
+type nopCloser struct {
+	io.Writer
 }
 
+func (nopCloser) Close() error { return nil }
+
+// CommandRunner runs command line tools. When the context is canceled, the
+// running command is terminated and CommandErrorCanceled is returned
 type CommandRunner interface {
-	RunCommand(*CommandLineTool) (*CommandLog, error)
+	RunCommand(context.Context, *CommandLineTool) (*CommandLog, error)
 }
 
 type SingleMachineRunner struct {
@@ -53,7 +198,7 @@ func NewSingleMachineRunner(ncpus uint, maxmb uint) CommandRunner {
 	}
 }
 
-func (sc *SingleMachineRunner) RunCommand(cmdTool *CommandLineTool) (*CommandLog, error) {
+func (sc *SingleMachineRunner) RunCommand(ctx context.Context, cmdTool *CommandLineTool) (*CommandLog, error) {
 	workdir, _ := filepath.Abs(cmdTool.BaseDir)
 
 	var err error
@@ -89,9 +234,24 @@ func (sc *SingleMachineRunner) RunCommand(cmdTool *CommandLineTool) (*CommandLog
 	*/
 	defer cpuAlloc.Return()
 	defer memAlloc.Return()
+
+	if ctx.Err() != nil {
+		return &CommandLog{ExitCode: -1, Canceled: true}, CommandErrorCanceled
+	}
+	if cmdTool.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cmdTool.Timeout)
+		defer cancel()
+	}
+
 	var cmd *exec.Cmd
+	containerName := ""
 	if cmdTool.Image != "" {
-		dockerCmd := []string{"docker", "run", "--rm"}
+		containerName = newContainerName()
+		dockerCmd := []string{"docker", "run", "--rm", "--name", containerName}
+		if cmdTool.Stdin != "" {
+			dockerCmd = append(dockerCmd, "-i")
+		}
 		u, _ := user.Current()
 		dockerCmd = append(dockerCmd, "--user", u.Uid)
 		dockerCmd = append(dockerCmd, "-v", workdir+":"+workdir)
@@ -113,23 +273,67 @@ func (sc *SingleMachineRunner) RunCommand(cmdTool *CommandLineTool) (*CommandLog
 		dockerCmd = append(dockerCmd, cmdTool.Image)
 		dockerCmd = append(dockerCmd, cmdTool.CommandLine...)
 		logger.Info("Executing", "dockerCommand", strings.Join(dockerCmd, " "))
-		cmd = exec.Command(dockerCmd[0], dockerCmd[1:]...)
+		cmd = exec.CommandContext(ctx, dockerCmd[0], dockerCmd[1:]...)
 		cmd.Dir = workdir
 	} else {
 		logger.Info("Executing", "commandLine", cmdTool.CommandLine)
-		cmd = exec.Command(cmdTool.CommandLine[0], cmdTool.CommandLine[1:]...)
+		cmd = exec.CommandContext(ctx, cmdTool.CommandLine[0], cmdTool.CommandLine[1:]...)
 		cmd.Dir = workdir
 	}
-	//TODO: manager tool output capture
-	//cmd.Stdout = os.Stderr
-	//cmd.Stderr = os.Stderr
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return stopCommand(cmd, containerName)
+	}
+	cmdLog := &CommandLog{}
+	stdin, stdout, stderr, err := openStdio(cmdTool, cmdLog)
+	if err != nil {
+		logger.Error("Unable to open command input and output", "commandLine", cmdTool.CommandLine, "error", err)
+		return cmdLog, err
+	}
+	defer stdout.Close()
+	defer stderr.Close()
+	if stdin != nil {
+		defer stdin.Close()
+		cmd.Stdin = stdin
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
 	logger.Debug("(%s) %s %s", cmd.Dir, cmd.Path, strings.Join(cmd.Args, " "))
 	//time.Sleep(5 * time.Second)
+	cmdLog.start()
 	err = cmd.Run()
+	cmdLog.finish(err)
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		cmdLog.TimedOut = true
+		err = CommandErrorTimeout
+	} else if errors.Is(ctx.Err(), context.Canceled) {
+		cmdLog.Canceled = true
+		err = CommandErrorCanceled
+	}
 	if err != nil {
-		logger.Error("Command exited with error", "commandLine", cmdTool.CommandLine, "error", err)
+		logger.Error("Command exited with error", "commandLine", cmdTool.CommandLine, "error", err, "stderr", cmdLog.StderrPath)
 	}
-	return &CommandLog{}, err
+	return cmdLog, err
+}
+
+// stopCommand terminates a running command and all of its children. Docker
+// containers are stopped with the docker client, as signalling the client
+// does not stop the container
+func stopCommand(cmd *exec.Cmd, containerName string) error {
+	if containerName != "" {
+		logger.Info("Stopping container", "name", containerName)
+		stop := exec.Command("docker", "stop", "--time", fmt.Sprintf("%d", int(killGracePeriod.Seconds())), containerName)
+		if err := stop.Run(); err != nil {
+			logger.Error("Unable to stop container", "name", containerName, "error", err)
+		}
+	}
+	return terminateProcessGroup(cmd, killGracePeriod)
+}
+
+func newContainerName() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return "lathe-" + hex.EncodeToString(b)
 }
 
 type PoolAllocation struct {
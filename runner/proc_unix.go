@@ -0,0 +1,28 @@
+//go:build !windows
+
+package runner
+
+import (
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// setProcessGroup starts the command in its own process group, so it and
+// all of its children can be signalled together
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// terminateProcessGroup sends SIGTERM to the process group of the command,
+// followed by SIGKILL if it is still running after the grace period
+func terminateProcessGroup(cmd *exec.Cmd, grace time.Duration) error {
+	pgid := -cmd.Process.Pid
+	if err := syscall.Kill(pgid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	time.AfterFunc(grace, func() {
+		syscall.Kill(pgid, syscall.SIGKILL)
+	})
+	return nil
+}
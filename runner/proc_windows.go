@@ -0,0 +1,14 @@
+//go:build windows
+
+package runner
+
+import (
+	"os/exec"
+	"time"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func terminateProcessGroup(cmd *exec.Cmd, grace time.Duration) error {
+	return cmd.Process.Kill()
+}
@@ -2,6 +2,7 @@ package runner
 
 import (
 	"context"
+	"errors"
 	"log"
 	"path/filepath"
 
@@ -21,7 +22,7 @@ func NewTesRunner(host string, defaultImage string) CommandRunner {
 	}
 }
 
-func (tr *TesRunner) RunCommand(cmdTool *CommandLineTool) (*CommandLog, error) {
+func (tr *TesRunner) RunCommand(ctx context.Context, cmdTool *CommandLineTool) (*CommandLog, error) {
 	workdir, _ := filepath.Abs(cmdTool.BaseDir)
 
 	inputs := []*tes.Input{}
@@ -45,6 +46,9 @@ func (tr *TesRunner) RunCommand(cmdTool *CommandLineTool) (*CommandLog, error) {
 				Image:   tr.DefaultImage,
 				Command: cmdTool.CommandLine,
 				Workdir: workdir,
+				Stdin:   redirectPath(workdir, cmdTool.Stdin),
+				Stdout:  redirectPath(workdir, cmdTool.Stdout),
+				Stderr:  redirectPath(workdir, cmdTool.Stderr),
 			},
 		},
 		Resources: &tes.Resources{
@@ -55,17 +59,71 @@ func (tr *TesRunner) RunCommand(cmdTool *CommandLineTool) (*CommandLog, error) {
 		Outputs: outputs,
 	}
 
-	resp, err := tr.Client.CreateTask(context.Background(), &task)
+	cmdLog := &CommandLog{}
+	cmdLog.start()
+	resp, err := tr.Client.CreateTask(ctx, &task)
 	if err != nil {
-		return nil, err
+		cmdLog.finish(err)
+		return cmdLog, err
 	}
 
 	resp.GetId()
 
-	err = tr.Client.WaitForTask(context.Background(), resp.Id)
+	if cmdTool.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cmdTool.Timeout)
+		defer cancel()
+	}
+
+	err = tr.Client.WaitForTask(ctx, resp.Id)
 	if err != nil {
 		log.Printf("Task Error: %s", err)
 	}
+	cmdLog.finish(err)
+	if ctx.Err() != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			cmdLog.TimedOut = true
+			err = CommandErrorTimeout
+		} else {
+			cmdLog.Canceled = true
+			err = CommandErrorCanceled
+		}
+		if _, cErr := tr.Client.CancelTask(context.Background(), &tes.CancelTaskRequest{Id: resp.Id}); cErr != nil {
+			log.Printf("Task Cancel Error: %s", cErr)
+		}
+	}
+	tr.writeLogs(resp.Id, cmdTool, cmdLog)
+
+	return cmdLog, err
+}
+
+// writeLogs copies the executor stdout, stderr and exit code reported by the
+// TES server into the command log
+func (tr *TesRunner) writeLogs(id string, cmdTool *CommandLineTool, cmdLog *CommandLog) {
+	t, err := tr.Client.GetTask(context.Background(), &tes.GetTaskRequest{Id: id, View: tes.TaskView_FULL})
+	if err != nil {
+		log.Printf("Task Log Error: %s", err)
+		return
+	}
+	stdout, stderr, err := openLogs(cmdTool, cmdLog)
+	if err != nil {
+		log.Printf("Task Log Error: %s", err)
+		return
+	}
+	defer stdout.Close()
+	defer stderr.Close()
+	for _, l := range t.Logs {
+		for _, e := range l.Logs {
+			stdout.Write([]byte(e.Stdout))
+			stderr.Write([]byte(e.Stderr))
+			cmdLog.ExitCode = int(e.ExitCode)
+		}
+	}
+}
 
-	return &CommandLog{}, err
+func redirectPath(workdir string, path string) string {
+	if path == "" {
+		return ""
+	}
+	return resolvePath(workdir, path)
 }
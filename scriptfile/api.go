@@ -6,6 +6,7 @@ import (
 	"io"
 	"os/exec"
 	"path/filepath"
+	"time"
 
 	"github.com/bmeg/lathe/logger"
 	"github.com/dop251/goja"
@@ -22,6 +23,8 @@ type Step interface {
 type File struct {
 	BasePath string
 	Path     string
+	// Source is the plan file and line where the file was declared
+	Source string
 }
 
 type Plan struct {
@@ -30,18 +33,26 @@ type Plan struct {
 	Path      string
 	VM        *goja.Runtime
 	Images    []*DockerImage
+	Params    map[string]any
+	modules   map[string]*module
 }
 
 func (pl *Plan) Process(data map[string]any) *ProcessDesc {
 
 	logger.Info("Process info", "data", data)
 
-	out := &ProcessDesc{BasePath: filepath.Dir(pl.Path)}
+	out := &ProcessDesc{BasePath: filepath.Dir(pl.Path), Source: pl.callSite()}
 
 	out.Desc = data
+	out.Issues = checkProcess(data)
+	for _, i := range out.Issues {
+		logger.Error("Process field error", "source", out.Source, "error", i)
+	}
 	//out.Dependencies = []*ProcessDesc{}
 	out.Inputs = map[string]string{}
 	out.Outputs = map[string]string{}
+	out.Dirs = map[string]bool{}
+	out.Temps = map[string]bool{}
 
 	if cmd, ok := data["commandLine"]; ok {
 		if cmdStr, ok := cmd.(string); ok {
@@ -55,11 +66,29 @@ func (pl *Plan) Process(data map[string]any) *ProcessDesc {
 		}
 	}
 
+	for _, k := range []string{"stdin", "stdout", "stderr"} {
+		if v, ok := data[k]; ok {
+			if vStr, ok := v.(string); ok {
+				switch k {
+				case "stdin":
+					out.Stdin = vStr
+				case "stdout":
+					out.Stdout = vStr
+				case "stderr":
+					out.Stderr = vStr
+				}
+			}
+		}
+	}
+
 	if inputs, ok := data["inputs"]; ok {
 		if inputsMap, ok := inputs.(map[string]any); ok {
 			for k, v := range inputsMap {
 				if vStr, ok := v.(string); ok {
 					out.Inputs[k] = vStr
+				} else if d, ok := v.(*Dir); ok {
+					out.Inputs[k] = d.Path
+					out.Dirs[d.Path] = true
 				}
 			}
 		}
@@ -70,6 +99,19 @@ func (pl *Plan) Process(data map[string]any) *ProcessDesc {
 			for k, v := range outputMap {
 				if vStr, ok := v.(string); ok {
 					out.Outputs[k] = vStr
+				} else if d, ok := v.(*Dir); ok {
+					out.Outputs[k] = d.Path
+					out.Dirs[d.Path] = true
+				} else if t, ok := v.(*Temp); ok {
+					out.Outputs[k] = t.Path
+					out.Temps[t.Path] = true
+				} else if m, ok := v.(map[string]any); ok {
+					if p, ok := m["path"].(string); ok {
+						out.Outputs[k] = p
+						if t, ok := m["temp"].(bool); ok && t {
+							out.Temps[p] = true
+						}
+					}
 				}
 			}
 		}
@@ -100,12 +142,64 @@ func (pl *Plan) Process(data map[string]any) *ProcessDesc {
 		}
 	}
 
+	if retries, ok := data["retries"]; ok {
+		if retriesInt, ok := retries.(int64); ok {
+			out.Retries = uint(retriesInt)
+		}
+	}
+
+	if delay, ok := data["retryDelay"]; ok {
+		if d, err := toDuration(delay); err == nil {
+			out.RetryDelay = d
+		} else {
+			logger.Error("Invalid retryDelay", "source", out.Source, "value", delay, "error", err)
+		}
+	}
+
+	if timeout, ok := data["timeout"]; ok {
+		if d, err := toDuration(timeout); err == nil {
+			out.Timeout = d
+		} else {
+			logger.Error("Invalid timeout", "source", out.Source, "value", timeout, "error", err)
+		}
+	}
+
+	if retryOn, ok := data["retryOn"]; ok {
+		if retryList, ok := retryOn.([]any); ok {
+			for _, c := range retryList {
+				if code, ok := c.(int64); ok {
+					out.RetryOn = append(out.RetryOn, int(code))
+				}
+			}
+		}
+	}
+
+	if atomic, ok := data["atomic"].(bool); ok {
+		out.Atomic = atomic
+	}
+
 	if name, ok := data["name"]; ok {
 		if nameStr, ok := name.(string); ok {
 			out.Name = nameStr
 		}
 	}
 
+	if after, ok := data["after"]; ok {
+		afterList, ok := after.([]any)
+		if !ok {
+			afterList = []any{after}
+		}
+		for _, a := range afterList {
+			if p, ok := a.(*ProcessDesc); ok {
+				out.After = append(out.After, p)
+			} else if name, ok := a.(string); ok {
+				out.AfterNames = append(out.AfterNames, name)
+			} else {
+				logger.Error("Unknown process dependency", "source", out.Source, "name", out.Name, "after", a)
+			}
+		}
+	}
+
 	return out
 }
 
@@ -115,22 +209,35 @@ func (pl *Plan) File(data map[string]any) *File {
 			return &File{
 				Path:     pathStr,
 				BasePath: pl.Path,
+				Source:   pl.callSite(),
 			}
 		}
 	}
+	logger.Error("File requires a path", "source", pl.callSite(), "data", data)
 	return nil
 }
 
+// Temp declares a temporary output, deleted once every step using it has
+// finished
+func (pl *Plan) Temp(path string) *Temp {
+	return &Temp{Path: path}
+}
+
+// Dir declares a directory, for use as a process input or output
+func (pl *Plan) Dir(path string) *Dir {
+	return &Dir{Path: path}
+}
+
 func (pl *Plan) Workflow(name string) *WorkflowDesc {
 	logger.Debug("Workflow Init", "name", name)
-	w := &WorkflowDesc{Name: fmt.Sprintf("%s:%s", pl.Path, name)}
+	w := &WorkflowDesc{Name: fmt.Sprintf("%s:%s", pl.Path, name), Source: pl.callSite(), plan: pl}
 	pl.Workflows[name] = w
 	return w
 }
 
 func (pl *Plan) DockerImage(call goja.ConstructorCall) *goja.Object {
 	if len(call.Arguments) != 2 {
-		fmt.Printf("2 arguments required for DockerImage")
+		logger.Error("2 arguments required for DockerImage", "source", pl.callSite())
 		return nil
 	}
 
@@ -145,6 +252,30 @@ func (pl *Plan) DockerImage(call goja.ConstructorCall) *goja.Object {
 	return nil
 }
 
+// callSite returns the file and line of the plan code that is calling into
+// the lathe object. Calls made from required helper modules are attributed
+// to the line of the plan file that called the helper
+func (pl *Plan) callSite() string {
+	first := ""
+	for _, f := range pl.VM.CaptureCallStack(0, nil) {
+		pos := f.Position()
+		if pos.Line <= 0 {
+			continue
+		}
+		site := fmt.Sprintf("%s:%d", pos.Filename, pos.Line)
+		if pos.Filename == pl.Path {
+			return site
+		}
+		if first == "" {
+			first = site
+		}
+	}
+	if first != "" {
+		return first
+	}
+	return pl.Path
+}
+
 func (pl *Plan) Print(x any) {
 	logger.Info(fmt.Sprintf("%s", x))
 }
@@ -159,12 +290,14 @@ func (pl *Plan) Glob(pattern string) []string {
 	return matches
 }
 
-func (pl *Plan) LoadPlan(path string) map[string]*WorkflowDesc {
+// LoadPlan evaluates another plan file, which inherits the params of this
+// plan. Values in the optional overrides object replace the inherited ones
+func (pl *Plan) LoadPlan(path string, overrides map[string]any) map[string]*WorkflowDesc {
 	logger.Debug("Loading sub-workflow", "path", path)
-	if x, err := RunFile(path); err == nil {
+	if x, err := RunFile(path, mergeParams(pl.Params, overrides)); err == nil {
 		return x.Workflows
 	} else {
-		logger.Error("Error Loading sub-workflow", "path", path, "error", err)
+		logger.Error("Error Loading sub-workflow", "source", pl.callSite(), "path", path, "error", err)
 	}
 	return map[string]*WorkflowDesc{}
 }
@@ -200,3 +333,17 @@ func (pl *Plan) Plugin(cmdLine string) goja.Value {
 	}
 	return nil
 }
+
+// toDuration converts a script value, either a duration string such as "30s"
+// or a number of seconds, to a time.Duration
+func toDuration(v any) (time.Duration, error) {
+	switch x := v.(type) {
+	case string:
+		return time.ParseDuration(x)
+	case int64:
+		return time.Duration(x) * time.Second, nil
+	case float64:
+		return time.Duration(x * float64(time.Second)), nil
+	}
+	return 0, fmt.Errorf("unknown duration type %T", v)
+}
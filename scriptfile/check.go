@@ -0,0 +1,136 @@
+package scriptfile
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// processKeys are the fields accepted by lathe.Process, and the type of
+// value each one takes
+var processKeys = map[string]string{
+	"name":        "string",
+	"commandLine": "string",
+	"shell":       "string",
+	"stdin":       "string",
+	"stdout":      "string",
+	"stderr":      "string",
+	"image":       "string",
+	"inputs":      "map",
+	"outputs":     "map",
+	"memMB":       "int",
+	"ncpus":       "int",
+	"retries":     "int",
+	"retryDelay":  "duration",
+	"timeout":     "duration",
+	"retryOn":     "intList",
+	"after":       "after",
+	"atomic":      "bool",
+}
+
+// checkProcess returns the problems with the fields passed to lathe.Process:
+// unknown keys and values of the wrong type, which are otherwise ignored
+func checkProcess(data map[string]any) []string {
+	out := []string{}
+	keys := []string{}
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := data[k]
+		kind, ok := processKeys[k]
+		if !ok {
+			msg := fmt.Sprintf("unknown key '%s'", k)
+			if s := similarKey(k); s != "" {
+				msg = fmt.Sprintf("%s, did you mean '%s'", msg, s)
+			}
+			out = append(out, msg)
+			continue
+		}
+		if v == nil {
+			continue
+		}
+		switch kind {
+		case "string":
+			if _, ok := v.(string); !ok {
+				out = append(out, fmt.Sprintf("'%s' must be a string, got %T", k, v))
+			}
+		case "map":
+			m, ok := v.(map[string]any)
+			if !ok {
+				out = append(out, fmt.Sprintf("'%s' must be an object of paths, got %T", k, v))
+				continue
+			}
+			for mk, mv := range m {
+				switch x := mv.(type) {
+				case string, *Dir:
+				case *Temp:
+					if k != "outputs" {
+						out = append(out, fmt.Sprintf("'%s.%s' lathe.Temp can only be used for outputs", k, mk))
+					}
+				case map[string]any:
+					if _, ok := x["path"].(string); !ok || k != "outputs" {
+						out = append(out, fmt.Sprintf("'%s.%s' must be a path, or {path, temp} for outputs", k, mk))
+					}
+					for ok := range x {
+						if ok != "path" && ok != "temp" {
+							out = append(out, fmt.Sprintf("'%s.%s' has unknown key '%s'", k, mk, ok))
+						}
+					}
+				default:
+					out = append(out, fmt.Sprintf("'%s.%s' must be a path or lathe.Dir, got %T", k, mk, mv))
+				}
+			}
+		case "bool":
+			if _, ok := v.(bool); !ok {
+				out = append(out, fmt.Sprintf("'%s' must be true or false, got %v", k, v))
+			}
+		case "int":
+			if i, ok := v.(int64); !ok {
+				out = append(out, fmt.Sprintf("'%s' must be an integer, got %v", k, v))
+			} else if i < 0 {
+				out = append(out, fmt.Sprintf("'%s' must not be negative, got %d", k, i))
+			}
+		case "duration":
+			if _, err := toDuration(v); err != nil {
+				out = append(out, fmt.Sprintf("'%s' is not a valid duration: %s", k, err))
+			}
+		case "intList":
+			l, ok := v.([]any)
+			if !ok {
+				out = append(out, fmt.Sprintf("'%s' must be a list of exit codes, got %T", k, v))
+				continue
+			}
+			for _, c := range l {
+				if _, ok := c.(int64); !ok {
+					out = append(out, fmt.Sprintf("'%s' must be a list of exit codes, got %v", k, c))
+				}
+			}
+		case "after":
+			l, ok := v.([]any)
+			if !ok {
+				l = []any{v}
+			}
+			for _, a := range l {
+				_, isProc := a.(*ProcessDesc)
+				_, isStr := a.(string)
+				if !isProc && !isStr {
+					out = append(out, fmt.Sprintf("'after' must list processes or step names, got %T", a))
+				}
+			}
+		}
+	}
+	return out
+}
+
+// similarKey finds the known key that differs from k only by case or a
+// trailing 's', to suggest for typos like 'memMb' or 'output'
+func similarKey(k string) string {
+	for known := range processKeys {
+		if strings.EqualFold(known, k) || strings.EqualFold(known, k+"s") || strings.EqualFold(known+"s", k) {
+			return known
+		}
+	}
+	return ""
+}
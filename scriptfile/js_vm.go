@@ -8,7 +8,9 @@ import (
 	"github.com/dop251/goja"
 )
 
-func RunFile(path string) (*Plan, error) {
+// RunFile evaluates a plan file. params are exposed to the script as
+// lathe.Params, if nil the DefaultParams are used
+func RunFile(path string, params map[string]any) (*Plan, error) {
 
 	// Try to get absolute path. If it fails, fall back to relative path.
 	path, abserr := filepath.Abs(path)
@@ -22,18 +24,24 @@ func RunFile(path string) (*Plan, error) {
 		return nil, fmt.Errorf("failed to read config at path %s: \n%v", path, err)
 	}
 
+	if params == nil {
+		params = DefaultParams()
+	}
+
 	vm := goja.New()
 
-	pl := &Plan{Workflows: map[string]*WorkflowDesc{}, Path: path, VM: vm, Images: []*DockerImage{}}
+	pl := &Plan{Workflows: map[string]*WorkflowDesc{}, Path: path, VM: vm, Images: []*DockerImage{}, Params: params, modules: map[string]*module{}}
 
 	latheObj := map[string]any{
-		"Params": map[string]string{
-			"mode": "prep",
-		},
+		"Params":      params,
 		"Workflow":    pl.Workflow,
 		"LoadPlan":    pl.LoadPlan,
 		"Process":     pl.Process,
+		"Scatter":     pl.Scatter,
+		"Rule":        pl.Rule,
 		"File":        pl.File,
+		"Dir":         pl.Dir,
+		"Temp":        pl.Temp,
 		"Plugin":      pl.Plugin,
 		"DockerImage": pl.DockerImage,
 	}
@@ -41,9 +49,10 @@ func RunFile(path string) (*Plan, error) {
 	vm.Set("print", pl.Print)
 	vm.Set("println", pl.Println)
 	vm.Set("glob", pl.Glob)
+	vm.Set("require", pl.requireFunc(filepath.Dir(path)))
 	vm.Set("lathe", latheObj)
 
-	_, err = vm.RunScript("main", string(source))
+	_, err = vm.RunScript(path, string(source))
 	if err != nil {
 		return nil, fmt.Errorf("error parsing: %s = %s", path, err)
 	}
@@ -0,0 +1,116 @@
+package scriptfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// DefaultParams are the values of lathe.Params when not set on the command line
+func DefaultParams() map[string]any {
+	return map[string]any{
+		"mode": "prep",
+	}
+}
+
+// ParseParams builds plan parameters from a YAML or JSON params file, followed
+// by a list of key=value strings. Numbers, booleans and JSON lists and
+// objects are typed, other values are strings
+func ParseParams(paramsFile string, params []string) (map[string]any, error) {
+	out := DefaultParams()
+	if paramsFile != "" {
+		data, err := os.ReadFile(paramsFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read params file %s: %s", paramsFile, err)
+		}
+		fileParams := map[string]any{}
+		if err := yaml.Unmarshal(data, &fileParams); err != nil {
+			return nil, fmt.Errorf("failed to parse params file %s: %s", paramsFile, err)
+		}
+		for k, v := range fileParams {
+			out[k] = v
+		}
+	}
+	for _, p := range params {
+		k, v, ok := strings.Cut(p, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("param '%s' not in key=value format", p)
+		}
+		out[k] = parseParam(v)
+	}
+	return out, nil
+}
+
+// parseParam types a --param value: booleans, numbers that print back the
+// same, and JSON lists and objects. Anything else, including numbers like
+// '1.10', '1e3' or '007' that would change, is kept as the string given
+func parseParam(v string) any {
+	switch v {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	if i, err := strconv.ParseInt(v, 10, 64); err == nil && strconv.FormatInt(i, 10) == v {
+		return i
+	}
+	if f, err := strconv.ParseFloat(v, 64); err == nil && !math.IsNaN(f) && strconv.FormatFloat(f, 'f', -1, 64) == v {
+		return f
+	}
+	t := strings.TrimSpace(v)
+	if !strings.HasPrefix(t, "[") && !strings.HasPrefix(t, "{") {
+		return v
+	}
+	dec := json.NewDecoder(strings.NewReader(t))
+	dec.UseNumber()
+	var val any
+	if err := dec.Decode(&val); err != nil || dec.More() {
+		return v
+	}
+	return jsonNumbers(val)
+}
+
+// jsonNumbers converts the numbers of a decoded JSON value to int64 or
+// float64. Integers too large for int64 are kept as strings, rather than
+// losing precision
+func jsonNumbers(v any) any {
+	switch x := v.(type) {
+	case json.Number:
+		if i, err := x.Int64(); err == nil {
+			return i
+		}
+		if !strings.ContainsAny(x.String(), ".eE") {
+			return x.String()
+		}
+		if f, err := x.Float64(); err == nil {
+			return f
+		}
+		return x.String()
+	case []any:
+		for i := range x {
+			x[i] = jsonNumbers(x[i])
+		}
+	case map[string]any:
+		for k := range x {
+			x[k] = jsonNumbers(x[k])
+		}
+	}
+	return v
+}
+
+// mergeParams returns a copy of base with the values in overrides replaced
+func mergeParams(base map[string]any, overrides map[string]any) map[string]any {
+	out := map[string]any{}
+	for k, v := range base {
+		out[k] = v
+	}
+	for k, v := range overrides {
+		out[k] = v
+	}
+	return out
+}
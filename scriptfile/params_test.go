@@ -0,0 +1,82 @@
+package scriptfile
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseParams(t *testing.T) {
+	cases := []struct {
+		param string
+		key   string
+		want  any
+	}{
+		{"v=1.10", "v", "1.10"},
+		{"id=1e3", "id", "1e3"},
+		{"n=3", "n", int64(3)},
+		{"mem=2048", "mem", int64(2048)},
+		{"neg=-4", "neg", int64(-4)},
+		{"f=2.5", "f", 2.5},
+		{"small=0.1", "small", 0.1},
+		{"zero=007", "zero", "007"},
+		{"plus=+3", "plus", "+3"},
+		{"big=12345678901234567890", "big", "12345678901234567890"},
+		{"inf=Inf", "inf", "Inf"},
+		{"nan=NaN", "nan", "NaN"},
+		{"flag=true", "flag", true},
+		{"dry=false", "dry", false},
+		{"title=True", "title", "True"},
+		{"null=null", "null", "null"},
+		{"s=a=b", "s", "a=b"},
+		{"empty=", "empty", ""},
+		{"mode=run", "mode", "run"},
+		{`ids=["a","b"]`, "ids", []any{"a", "b"}},
+		{`nums=[1, 2.5, 12345678901234567890]`, "nums", []any{int64(1), 2.5, "12345678901234567890"}},
+		{`obj={"n": 3, "l": [true]}`, "obj", map[string]any{"n": int64(3), "l": []any{true}}},
+		{`bad=[1,`, "bad", "[1,"},
+		{`two={} {}`, "two", "{} {}"},
+	}
+	for _, c := range cases {
+		out, err := ParseParams("", []string{c.param})
+		if err != nil {
+			t.Errorf("%s: %s", c.param, err)
+			continue
+		}
+		if !reflect.DeepEqual(out[c.key], c.want) {
+			t.Errorf("%s: got %#v, want %#v", c.param, out[c.key], c.want)
+		}
+	}
+}
+
+func TestParseParamsErrors(t *testing.T) {
+	for _, p := range []string{"novalue", "=x"} {
+		if _, err := ParseParams("", []string{p}); err == nil {
+			t.Errorf("%s: expected error", p)
+		}
+	}
+	if _, err := ParseParams("/nonexistent/params.yaml", nil); err == nil {
+		t.Errorf("missing params file: expected error")
+	}
+}
+
+func TestParseParamsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "params.yaml")
+	if err := os.WriteFile(path, []byte("count: 3\nname: file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := ParseParams(path, []string{"name=cli"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out["name"] != "cli" {
+		t.Errorf("command line should override the file, got %#v", out["name"])
+	}
+	if out["count"] != float64(3) {
+		t.Errorf("file values should keep their type, got %#v", out["count"])
+	}
+	if out["mode"] != "prep" {
+		t.Errorf("defaults should be kept, got %#v", out["mode"])
+	}
+}
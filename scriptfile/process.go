@@ -1,16 +1,61 @@
 package scriptfile
 
+import "time"
+
 type ProcessDesc struct {
 	BasePath    string
 	Name        string
 	Desc        map[string]any
 	CommandLine string
 	Shell       string
+	Stdin       string
+	Stdout      string
+	Stderr      string
 	Inputs      map[string]string
 	Outputs     map[string]string
 	MemMB       uint
 	NCpus       uint
 	Image       string
+	Retries     uint
+	RetryDelay  time.Duration
+	RetryOn     []int
+	Timeout     time.Duration
+	After       []*ProcessDesc
+	AfterNames  []string
+	// Source is the plan file and line where the process was declared
+	Source string
+	// Issues are the problems found with the fields passed to lathe.Process
+	Issues []string
+	// Group is the name of the Scatter that created the process, if any
+	Group string
+	// Wildcards are the values a Rule was instantiated with, if any
+	Wildcards map[string]string
+	// Dirs are the input and output paths declared with lathe.Dir
+	Dirs map[string]bool
+	// Temps are the output paths that are deleted once every step using them
+	// has finished
+	Temps map[string]bool
+	// Atomic steps write their outputs to a staging directory, and they are
+	// moved into place once the command succeeds
+	Atomic bool
+}
+
+// Dir marks an input or output path as a directory. Its freshness and hash
+// cover everything inside it
+type Dir struct {
+	Path string
+}
+
+// Temp marks an output path as temporary
+type Temp struct {
+	Path string
+}
+
+// DependsOn declares that this process must run after p, even though no
+// output of p is an input of this process
+func (pd *ProcessDesc) DependsOn(p *ProcessDesc) *ProcessDesc {
+	pd.After = append(pd.After, p)
+	return pd
 }
 
 func (pd *ProcessDesc) GetName() string {
@@ -0,0 +1,103 @@
+package scriptfile
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+// module is a file loaded with require. exports is kept while the module is
+// being evaluated, so circular requires get the partial exports
+type module struct {
+	exports goja.Value
+	obj     *goja.Object
+}
+
+// requireFunc returns the require function for code in dir. Paths are
+// resolved relative to dir, and each file is evaluated once per plan
+func (pl *Plan) requireFunc(dir string) func(goja.FunctionCall) goja.Value {
+	return func(call goja.FunctionCall) goja.Value {
+		name := call.Argument(0).String()
+		path, err := resolveModule(dir, name)
+		if err != nil {
+			panic(pl.VM.NewGoError(err))
+		}
+		if m, ok := pl.modules[path]; ok {
+			if m.obj != nil {
+				return m.obj.Get("exports")
+			}
+			return m.exports
+		}
+		v, err := pl.loadModule(path)
+		if ex, ok := err.(*goja.Exception); ok {
+			//rethrow errors from the module's own code unchanged
+			panic(ex)
+		} else if err != nil {
+			panic(pl.VM.NewGoError(err))
+		}
+		return v
+	}
+}
+
+// resolveModule finds the file for a require path: the path itself, the path
+// with .js or .json added, or index.js in the directory it names
+func resolveModule(dir string, name string) (string, error) {
+	if !strings.HasPrefix(name, "./") && !strings.HasPrefix(name, "../") && !filepath.IsAbs(name) {
+		return "", fmt.Errorf("require '%s': only relative or absolute paths are supported", name)
+	}
+	base := name
+	if !filepath.IsAbs(base) {
+		base = filepath.Join(dir, name)
+	}
+	for _, p := range []string{base, base + ".js", base + ".json", filepath.Join(base, "index.js")} {
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			return filepath.Abs(p)
+		}
+	}
+	return "", fmt.Errorf("require '%s': module not found from %s", name, dir)
+}
+
+func (pl *Plan) loadModule(path string) (goja.Value, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if filepath.Ext(path) == ".json" {
+		var data any
+		if err := json.Unmarshal(source, &data); err != nil {
+			return nil, fmt.Errorf("require %s: %s", path, err)
+		}
+		v := pl.VM.ToValue(data)
+		pl.modules[path] = &module{exports: v}
+		return v, nil
+	}
+
+	//keep the wrapper on the first line, so line numbers match the file
+	wrapped := "(function(exports, require, module, __filename, __dirname) {" + string(source) + "\n})"
+	prg, err := goja.Compile(path, wrapped, false)
+	if err != nil {
+		return nil, err
+	}
+	f, err := pl.VM.RunProgram(prg)
+	if err != nil {
+		return nil, err
+	}
+	fn, ok := goja.AssertFunction(f)
+	if !ok {
+		return nil, fmt.Errorf("require %s: module did not compile to a function", path)
+	}
+	obj := pl.VM.NewObject()
+	exports := pl.VM.NewObject()
+	obj.Set("exports", exports)
+	pl.modules[path] = &module{obj: obj}
+	dir := filepath.Dir(path)
+	if _, err := fn(goja.Undefined(), exports, pl.VM.ToValue(pl.requireFunc(dir)), obj, pl.VM.ToValue(path), pl.VM.ToValue(dir)); err != nil {
+		delete(pl.modules, path)
+		return nil, err
+	}
+	return obj.Get("exports"), nil
+}
@@ -0,0 +1,249 @@
+package scriptfile
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var wildcardRe = regexp.MustCompile(`\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// RuleDesc is a pattern rule. Its input and output paths contain wildcards,
+// like 'out/{sample}.json', and a process is created for every path a
+// workflow needs that matches one of the output patterns
+type RuleDesc struct {
+	Name     string
+	BasePath string
+	Source   string
+	// Template is the process the rule describes, with the patterns as paths
+	Template  *ProcessDesc
+	Inputs    map[string]string
+	Outputs   map[string]string
+	Wildcards []string
+	outRegex  map[string]*regexp.Regexp
+}
+
+// Rule declares a pattern rule. It takes the same fields as lathe.Process,
+// stdin, stdout and stderr paths may use the wildcards as well
+func (pl *Plan) Rule(data map[string]any) *RuleDesc {
+	tmpl := pl.Process(data)
+	r := &RuleDesc{
+		Name:     tmpl.Name,
+		BasePath: tmpl.BasePath,
+		Source:   tmpl.Source,
+		Template: tmpl,
+		Inputs:   map[string]string{},
+		Outputs:  map[string]string{},
+		outRegex: map[string]*regexp.Regexp{},
+	}
+	for k, v := range tmpl.Inputs {
+		r.Inputs[k] = v
+	}
+	for k, v := range tmpl.Outputs {
+		r.Outputs[k] = v
+	}
+	for k, v := range map[string]string{"stdin": tmpl.Stdin, "stdout": tmpl.Stdout, "stderr": tmpl.Stderr} {
+		if v == "" {
+			continue
+		}
+		if k == "stdin" {
+			r.Inputs["<"+k+">"] = v
+		} else {
+			r.Outputs["<"+k+">"] = v
+		}
+	}
+	if err := r.compile(); err != nil {
+		panic(pl.VM.NewGoError(fmt.Errorf("%s: rule %s: %s", r.Source, r.Name, err)))
+	}
+	return r
+}
+
+func (r *RuleDesc) compile() error {
+	if len(r.Outputs) == 0 {
+		return fmt.Errorf("rules need at least one output")
+	}
+	keys := []string{}
+	for k := range r.Outputs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if r.Name == "" {
+		r.Name = "rule:" + r.Outputs[keys[0]]
+	}
+
+	wildcards := map[string]bool{}
+	for i, k := range keys {
+		names := patternWildcards(r.Outputs[k])
+		if i == 0 {
+			for _, n := range names {
+				wildcards[n] = true
+				r.Wildcards = append(r.Wildcards, n)
+			}
+		} else if !sameSet(names, r.Wildcards) {
+			return fmt.Errorf("outputs %s and %s use different wildcards", keys[0], k)
+		}
+		re, err := patternRegex(r.absPattern(r.Outputs[k]))
+		if err != nil {
+			return err
+		}
+		r.outRegex[k] = re
+	}
+	sort.Strings(r.Wildcards)
+	for k, v := range r.Inputs {
+		for _, n := range patternWildcards(v) {
+			if !wildcards[n] {
+				return fmt.Errorf("input %s uses wildcard {%s}, which is not in the outputs", k, n)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *RuleDesc) absPattern(p string) string {
+	if filepath.IsAbs(p) {
+		return filepath.Clean(p)
+	}
+	return filepath.Join(r.BasePath, p)
+}
+
+// Match checks if an absolute path matches one of the output patterns of the
+// rule, and returns the values of the wildcards
+func (r *RuleDesc) Match(path string) (map[string]string, bool) {
+	keys := []string{}
+	for k := range r.outRegex {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		re := r.outRegex[k]
+		m := re.FindStringSubmatch(path)
+		if m == nil {
+			continue
+		}
+		out := map[string]string{}
+		consistent := true
+		for i, n := range re.SubexpNames() {
+			if i == 0 || n == "" {
+				continue
+			}
+			//wildcards used more than once get numbered groups, like sample_1
+			name := n[:strings.LastIndex(n, "_")]
+			if v, ok := out[name]; ok && v != m[i] {
+				consistent = false
+			}
+			out[name] = m[i]
+		}
+		if consistent {
+			return out, true
+		}
+	}
+	return nil, false
+}
+
+// Instantiate creates the process for one set of wildcard values
+func (r *RuleDesc) Instantiate(wildcards map[string]string) *ProcessDesc {
+	p := *r.Template
+	p.Inputs = map[string]string{}
+	for k, v := range r.Template.Inputs {
+		p.Inputs[k] = expandPattern(v, wildcards)
+	}
+	p.Outputs = map[string]string{}
+	for k, v := range r.Template.Outputs {
+		p.Outputs[k] = expandPattern(v, wildcards)
+	}
+	p.Dirs = map[string]bool{}
+	for d := range r.Template.Dirs {
+		p.Dirs[expandPattern(d, wildcards)] = true
+	}
+	p.Temps = map[string]bool{}
+	for t := range r.Template.Temps {
+		p.Temps[expandPattern(t, wildcards)] = true
+	}
+	p.Stdin = expandPattern(p.Stdin, wildcards)
+	p.Stdout = expandPattern(p.Stdout, wildcards)
+	p.Stderr = expandPattern(p.Stderr, wildcards)
+	values := []string{}
+	for _, n := range r.Wildcards {
+		values = append(values, wildcards[n])
+	}
+	p.Name = r.Name
+	if len(values) > 0 {
+		p.Name = fmt.Sprintf("%s:%s", r.Name, strings.Join(values, ","))
+	}
+	p.Wildcards = wildcards
+	return &p
+}
+
+// findWildcards returns the locations of the {name} wildcards in a pattern,
+// skipping handlebars expressions like {{name}}
+func findWildcards(p string) [][]int {
+	out := [][]int{}
+	for _, loc := range wildcardRe.FindAllStringSubmatchIndex(p, -1) {
+		if (loc[0] > 0 && p[loc[0]-1] == '{') || (loc[1] < len(p) && p[loc[1]] == '}') {
+			continue
+		}
+		out = append(out, loc)
+	}
+	return out
+}
+
+func patternWildcards(p string) []string {
+	out := []string{}
+	seen := map[string]bool{}
+	for _, loc := range findWildcards(p) {
+		name := p[loc[2]:loc[3]]
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func patternRegex(p string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	last := 0
+	count := map[string]int{}
+	for _, loc := range findWildcards(p) {
+		sb.WriteString(regexp.QuoteMeta(p[last:loc[0]]))
+		name := p[loc[2]:loc[3]]
+		count[name]++
+		sb.WriteString(fmt.Sprintf("(?P<%s_%d>.+)", name, count[name]))
+		last = loc[1]
+	}
+	sb.WriteString(regexp.QuoteMeta(p[last:]))
+	sb.WriteString("$")
+	return regexp.Compile(sb.String())
+}
+
+func expandPattern(p string, wildcards map[string]string) string {
+	var sb strings.Builder
+	last := 0
+	for _, loc := range findWildcards(p) {
+		sb.WriteString(p[last:loc[0]])
+		sb.WriteString(wildcards[p[loc[2]:loc[3]]])
+		last = loc[1]
+	}
+	sb.WriteString(p[last:])
+	return sb.String()
+}
+
+func sameSet(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := map[string]bool{}
+	for _, x := range a {
+		set[x] = true
+	}
+	for _, x := range b {
+		if !set[x] {
+			return false
+		}
+	}
+	return true
+}
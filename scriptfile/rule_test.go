@@ -0,0 +1,137 @@
+package scriptfile
+
+import (
+	"reflect"
+	"regexp"
+	"testing"
+)
+
+func testRule(t *testing.T, inputs map[string]string, outputs map[string]string) *RuleDesc {
+	t.Helper()
+	r := &RuleDesc{
+		Name:     "r",
+		BasePath: "/w",
+		Template: &ProcessDesc{Name: "r", BasePath: "/w", Inputs: inputs, Outputs: outputs},
+		Inputs:   inputs,
+		Outputs:  outputs,
+		outRegex: map[string]*regexp.Regexp{},
+	}
+	if err := r.compile(); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestRuleMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		path    string
+		want    map[string]string
+	}{
+		{"out/{sample}.json", "/w/out/a.json", map[string]string{"sample": "a"}},
+		{"out/{sample}.json", "/w/out/sub/a.json", map[string]string{"sample": "sub/a"}},
+		{"out/{sample}.json", "/w/out/a.txt", nil},
+		{"out/{sample}.json", "/w/other/a.json", nil},
+		{"out/{sample}.json", "/x/out/a.json", nil},
+		{"out/{sample}.json", "/w/out/.json", nil},
+		{"/abs/{sample}.json", "/abs/a.json", map[string]string{"sample": "a"}},
+		{"{s}/{s}.txt", "/w/a/a.txt", map[string]string{"s": "a"}},
+		{"{s}/{s}.txt", "/w/a/b.txt", nil},
+		{"{a}_{b}.txt", "/w/x_y.txt", map[string]string{"a": "x", "b": "y"}},
+		{"{a}_{b}.txt", "/w/x_y_z.txt", map[string]string{"a": "x_y", "b": "z"}},
+		{"out/{s}.{{ext}}", "/w/out/a.{{ext}}", map[string]string{"s": "a"}},
+		{"a+b/{s}(1).txt", "/w/a+b/x(1).txt", map[string]string{"s": "x"}},
+		{"a+b/{s}(1).txt", "/w/aab/x1.txt", nil},
+	}
+	for _, c := range cases {
+		r := testRule(t, map[string]string{}, map[string]string{"o": c.pattern})
+		got, ok := r.Match(c.path)
+		if c.want == nil {
+			if ok {
+				t.Errorf("%s matched %s with %v", c.pattern, c.path, got)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("%s did not match %s", c.pattern, c.path)
+		} else if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s on %s: got %v, want %v", c.pattern, c.path, got, c.want)
+		}
+	}
+}
+
+func TestRuleMatchOutputs(t *testing.T) {
+	r := testRule(t, map[string]string{"i": "in/{s}.tsv"}, map[string]string{"json": "out/{s}.json", "log": "logs/{s}.log"})
+	for path, want := range map[string]string{"/w/out/a.json": "a", "/w/logs/b.log": "b"} {
+		got, ok := r.Match(path)
+		if !ok || got["s"] != want {
+			t.Errorf("%s: got %v, want s=%s", path, got, want)
+		}
+	}
+	p := r.Instantiate(map[string]string{"s": "a"})
+	if p.Name != "r:a" {
+		t.Errorf("instance name %s, want r:a", p.Name)
+	}
+	if p.Inputs["i"] != "in/a.tsv" || p.Outputs["json"] != "out/a.json" || p.Outputs["log"] != "logs/a.log" {
+		t.Errorf("instance paths %v %v", p.Inputs, p.Outputs)
+	}
+	if r.Template.Outputs["json"] != "out/{s}.json" {
+		t.Errorf("instantiating changed the template: %v", r.Template.Outputs)
+	}
+}
+
+func TestRuleCompileErrors(t *testing.T) {
+	cases := []struct {
+		inputs  map[string]string
+		outputs map[string]string
+	}{
+		{map[string]string{"i": "{s}.txt"}, map[string]string{}},
+		{map[string]string{}, map[string]string{"a": "{s}.txt", "b": "{t}.txt"}},
+		{map[string]string{"i": "{t}.tsv"}, map[string]string{"o": "{s}.txt"}},
+	}
+	for _, c := range cases {
+		r := &RuleDesc{BasePath: "/w", Inputs: c.inputs, Outputs: c.outputs, outRegex: map[string]*regexp.Regexp{}}
+		if err := r.compile(); err == nil {
+			t.Errorf("inputs %v outputs %v: expected error", c.inputs, c.outputs)
+		}
+	}
+}
+
+func TestPatternWildcards(t *testing.T) {
+	cases := []struct {
+		pattern string
+		want    []string
+	}{
+		{"out/{s}.txt", []string{"s"}},
+		{"{b}/{a}/{b}.txt", []string{"a", "b"}},
+		{"{{s}}.txt", []string{}},
+		{"{{{s}}}.txt", []string{}},
+		{"{{inputs.x}}/{s}", []string{"s"}},
+		{"{1s}.txt", []string{}},
+		{"plain.txt", []string{}},
+	}
+	for _, c := range cases {
+		if got := patternWildcards(c.pattern); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.pattern, got, c.want)
+		}
+	}
+}
+
+func TestExpandPattern(t *testing.T) {
+	cases := []struct {
+		pattern string
+		want    string
+	}{
+		{"out/{s}.txt", "out/a.txt"},
+		{"{s}/{s}.txt", "a/a.txt"},
+		{"{s}_{t}.txt", "a_b.txt"},
+		{"{s}.{{ext}}", "a.{{ext}}"},
+		{"{u}.txt", ".txt"},
+		{"plain.txt", "plain.txt"},
+	}
+	for _, c := range cases {
+		if got := expandPattern(c.pattern, map[string]string{"s": "a", "t": "b"}); got != c.want {
+			t.Errorf("%s: got %s, want %s", c.pattern, got, c.want)
+		}
+	}
+}
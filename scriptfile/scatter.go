@@ -0,0 +1,91 @@
+package scriptfile
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmeg/lathe/logger"
+	"github.com/dop251/goja"
+)
+
+// Scatter creates one process per item of a list. The process function is
+// called with each item and its index, and returns a Process object or the
+// fields for one. Processes without a name are named '<name>:<item>', using
+// the item itself, or its 'name' or 'id' field, so names stay the same when
+// items are added or removed. The result can be added to a workflow
+func (pl *Plan) Scatter(data *goja.Object) *WorkflowDesc {
+	source := pl.callSite()
+	out := &WorkflowDesc{Source: source, plan: pl}
+
+	name := ""
+	if v := data.Get("name"); v != nil && !goja.IsUndefined(v) {
+		name = v.String()
+	}
+	if name == "" {
+		panic(pl.VM.NewGoError(fmt.Errorf("%s: Scatter requires a name", source)))
+	}
+	out.Name = name
+
+	fn, ok := goja.AssertFunction(data.Get("process"))
+	if !ok {
+		panic(pl.VM.NewGoError(fmt.Errorf("%s: Scatter %s requires a process function", source, name)))
+	}
+
+	items := []any{}
+	if v := data.Get("over"); v != nil && !goja.IsUndefined(v) {
+		if err := pl.VM.ExportTo(v, &items); err != nil {
+			panic(pl.VM.NewGoError(fmt.Errorf("%s: Scatter %s 'over' must be a list: %s", source, name, err)))
+		}
+	}
+
+	names := map[string]bool{}
+	for i, item := range items {
+		res, err := fn(goja.Undefined(), pl.VM.ToValue(item), pl.VM.ToValue(i))
+		if err != nil {
+			panic(err)
+		}
+		var proc *ProcessDesc
+		switch r := res.Export().(type) {
+		case *ProcessDesc:
+			proc = r
+		case map[string]any:
+			proc = pl.Process(r)
+		default:
+			panic(pl.VM.NewGoError(fmt.Errorf("%s: Scatter %s process function must return a Process, got %T", source, name, r)))
+		}
+		if proc.Name == "" {
+			proc.Name = fmt.Sprintf("%s:%s", name, pl.itemKey(item, i))
+			if names[proc.Name] {
+				proc.Name = fmt.Sprintf("%s:%d", name, i)
+			}
+		}
+		names[proc.Name] = true
+		proc.Group = name
+		out.Steps = append(out.Steps, proc)
+	}
+	logger.Debug("Scatter", "name", name, "count", len(out.Steps))
+	return out
+}
+
+// itemKey is the stable part of the name of a scattered process
+func (pl *Plan) itemKey(item any, index int) string {
+	switch v := item.(type) {
+	case string:
+		if filepath.IsAbs(v) {
+			if rel, err := filepath.Rel(filepath.Dir(pl.Path), v); err == nil && !strings.HasPrefix(rel, "..") {
+				return rel
+			}
+		}
+		return v
+	case map[string]any:
+		for _, k := range []string{"name", "id"} {
+			if s, ok := v[k].(string); ok && s != "" {
+				return s
+			}
+		}
+	case int64, float64:
+		return fmt.Sprintf("%v", v)
+	}
+	return fmt.Sprintf("%d", index)
+}
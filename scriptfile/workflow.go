@@ -10,6 +10,19 @@ import (
 type WorkflowDesc struct {
 	Name  string
 	Steps []Step
+	// Rules are the pattern rules used to create steps for needed files
+	Rules []*RuleDesc
+	// Source is the plan file and line where the workflow was declared
+	Source string
+	plan   *Plan
+}
+
+// callSite returns the plan location of the current call into the workflow
+func (wd *WorkflowDesc) callSite() string {
+	if wd.plan == nil {
+		return wd.Source
+	}
+	return wd.plan.callSite()
 }
 
 //func (pd *ProcessDesc) Depends(p *ProcessDesc) {
@@ -32,11 +45,15 @@ func (wd *WorkflowDesc) Add(call goja.ConstructorCall) *goja.Object {
 	} else if wf, ok := e.(*WorkflowDesc); ok {
 		logger.Debug("Adding subworkflow", "parent", wd.Name, "name", wf.Name, "stepCount", len(wf.Steps))
 		wd.Steps = append(wd.Steps, wf.Steps...)
+		wd.Rules = append(wd.Rules, wf.Rules...)
+	} else if rule, ok := e.(*RuleDesc); ok {
+		logger.Debug("Adding rule", "parent", wd.Name, "name", rule.Name)
+		wd.Rules = append(wd.Rules, rule)
 	} else if file, ok := e.(*File); ok {
 		logger.Debug("Adding file check", "path", file)
 		wd.Steps = append(wd.Steps, &FileCheck{File: file})
 	} else {
-		logger.Error("Unknown object", "error", e)
+		logger.Error("Unknown object", "source", wd.callSite(), "workflow", wd.Name, "object", e)
 	}
 	return nil
 }
@@ -0,0 +1,311 @@
+package state
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/bmeg/lathe/util"
+	"github.com/cockroachdb/pebble"
+)
+
+// FileRecord describes the state of a file at the time it was recorded
+type FileRecord struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Hash    string    `json:"hash"`
+	// Deleted is set once a temporary output has been removed
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// StepRecord is the state of a workflow step after its last successful run.
+// Mode is the up-to-date check used when the record was made, file records
+// only carry content hashes when it was 'hash'
+type StepRecord struct {
+	Name      string                `json:"name"`
+	Signature string                `json:"signature"`
+	Mode      string                `json:"mode"`
+	Inputs    map[string]FileRecord `json:"inputs"`
+	Outputs   map[string]FileRecord `json:"outputs"`
+	Time      time.Time             `json:"time"`
+}
+
+// Store is a persistent database of step and file state, kept in the
+// .lathe directory next to the plan file
+type Store struct {
+	db       *pebble.DB
+	readOnly bool
+	// snapshot is the copy of a locked database opened by OpenReadOnly,
+	// removed on Close
+	snapshot string
+}
+
+// ErrLocked is returned when another lathe process, usually a 'lathe run',
+// holds the lock on the state database
+var ErrLocked = errors.New("state database is locked by a running 'lathe run'")
+
+// errReadOnly is returned when writing to a store opened by OpenReadOnly
+// that has no database
+var errReadOnly = errors.New("state database is read only")
+
+const (
+	stepPrefix = "step/"
+	filePrefix = "file/"
+)
+
+// LatheDir returns the directory lathe uses to keep state for a plan file
+func LatheDir(planPath string) string {
+	return filepath.Join(filepath.Dir(planPath), ".lathe")
+}
+
+// Open opens (or creates) the state database at path
+func Open(path string) (*Store, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	db, err := pebble.Open(path, &pebble.Options{})
+	if err != nil {
+		if isLocked(err) {
+			return nil, fmt.Errorf("%s: %w", path, ErrLocked)
+		}
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// OpenReadOnly opens the state database at path for reading. While a run
+// holds the lock, a copy of the database is read instead, which shows the
+// state as of the time it was opened. If there is no database yet, the store
+// is empty, and nothing is created
+func OpenReadOnly(path string) (*Store, error) {
+	if _, err := os.Stat(filepath.Join(path, "CURRENT")); errors.Is(err, fs.ErrNotExist) {
+		return &Store{readOnly: true}, nil
+	}
+	db, err := pebble.Open(path, &pebble.Options{ReadOnly: true})
+	if err == nil {
+		return &Store{db: db, readOnly: true}, nil
+	}
+	if !isLocked(err) {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp("", "lathe-state-")
+	if err != nil {
+		return nil, err
+	}
+	if err := copySnapshot(path, tmp); err == nil {
+		if db, err := pebble.Open(tmp, &pebble.Options{ReadOnly: true}); err == nil {
+			return &Store{db: db, readOnly: true, snapshot: tmp}, nil
+		}
+	}
+	os.RemoveAll(tmp)
+	return nil, fmt.Errorf("%s: %w", path, ErrLocked)
+}
+
+// isLocked checks if opening a database failed because another process holds
+// its lock
+func isLocked(err error) bool {
+	return errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EACCES)
+}
+
+// copySnapshot copies the files of a database, except for its lock
+func copySnapshot(src string, dst string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.IsDir() || e.Name() == "LOCK" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(src, e.Name()))
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dst, e.Name()), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Store) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	err := s.db.Close()
+	if s.snapshot != "" {
+		os.RemoveAll(s.snapshot)
+	}
+	return err
+}
+
+func (s *Store) get(key string, dst any) (bool, error) {
+	if s.db == nil {
+		return false, nil
+	}
+	data, closer, err := s.db.Get([]byte(key))
+	if errors.Is(err, pebble.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer closer.Close()
+	if err := json.Unmarshal(data, dst); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) set(key string, val any) error {
+	data, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	if s.db == nil {
+		return errReadOnly
+	}
+	return s.db.Set([]byte(key), data, pebble.Sync)
+}
+
+// GetStep returns the record for a step, or nil if the step has never been recorded
+func (s *Store) GetStep(name string) (*StepRecord, error) {
+	out := &StepRecord{}
+	found, err := s.get(stepPrefix+name, out)
+	if err != nil || !found {
+		return nil, err
+	}
+	return out, nil
+}
+
+// PutStep saves the record for a step
+func (s *Store) PutStep(rec *StepRecord) error {
+	rec.Time = time.Now()
+	return s.set(stepPrefix+rec.Name, rec)
+}
+
+// DeleteStep removes the record of a step, so it is treated as never run
+func (s *Store) DeleteStep(name string) error {
+	if s.db == nil {
+		return errReadOnly
+	}
+	return s.db.Delete([]byte(stepPrefix+name), pebble.Sync)
+}
+
+// MarkDeleted records that an output of a step was deleted on purpose,
+// without changing the time of the step's last run
+func (s *Store) MarkDeleted(name string, path string) error {
+	rec, err := s.GetStep(name)
+	if err != nil || rec == nil {
+		return err
+	}
+	r, ok := rec.Outputs[path]
+	if !ok {
+		return nil
+	}
+	r.Deleted = true
+	rec.Outputs[path] = r
+	return s.set(stepPrefix+name, rec)
+}
+
+// StatFile returns a record, without content hash, for a file. For a
+// directory, the size is the total of the files in it and the modification
+// time is the newest of its contents
+func StatFile(path string) (FileRecord, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileRecord{}, err
+	}
+	if !info.IsDir() {
+		return FileRecord{Path: path, Size: info.Size(), ModTime: info.ModTime()}, nil
+	}
+	out := FileRecord{Path: path}
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		i, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			out.Size += i.Size()
+		}
+		if i.ModTime().After(out.ModTime) {
+			out.ModTime = i.ModTime()
+		}
+		return nil
+	})
+	return out, err
+}
+
+// HashFile returns a record, including content hash, for a file. Hashes are
+// cached by path, size and modification time, so unchanged files are not re-read.
+// A directory is hashed from the relative paths and hashes of the files in it
+func (s *Store) HashFile(path string) (FileRecord, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileRecord{}, err
+	}
+	if info.IsDir() {
+		return s.hashDir(path)
+	}
+	cached := FileRecord{}
+	found, err := s.get(filePrefix+path, &cached)
+	if err == nil && found && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+		return cached, nil
+	}
+	hash, err := util.SHA1(path)
+	if err != nil {
+		return FileRecord{}, err
+	}
+	out := FileRecord{Path: path, Size: info.Size(), ModTime: info.ModTime(), Hash: hash}
+	if s.readOnly {
+		return out, nil
+	}
+	if err := s.set(filePrefix+path, out); err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+func (s *Store) hashDir(path string) (FileRecord, error) {
+	out, err := StatFile(path)
+	if err != nil {
+		return out, err
+	}
+	h := sha1.New()
+	//WalkDir visits entries in lexical order, so the hash is stable
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(path, p)
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			fmt.Fprintf(h, "%s\x00%s\n", rel, d.Type())
+			return nil
+		}
+		r, err := s.HashFile(p)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%s\x00%s\n", rel, r.Hash)
+		return nil
+	})
+	if err != nil {
+		return FileRecord{}, err
+	}
+	out.Hash = hex.EncodeToString(h.Sum(nil))
+	return out, nil
+}
@@ -0,0 +1,26 @@
+package state
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenReadOnlyMissing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".lathe", "state")
+	s, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if rec, err := s.GetStep("a"); rec != nil || err != nil {
+		t.Errorf("expected no record, got %v %v", rec, err)
+	}
+	if err := s.PutStep(&StepRecord{Name: "a"}); err == nil {
+		t.Errorf("expected writes to fail")
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("state database was created: %v", err)
+	}
+}
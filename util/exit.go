@@ -0,0 +1,25 @@
+package util
+
+// Process exit codes
+const (
+	EXIT_OK            = 0
+	EXIT_ERROR         = 1
+	EXIT_STEP_FAILED   = 2
+	EXIT_MISSING_INPUT = 3
+	EXIT_PLAN_ERROR    = 4
+	EXIT_INTERRUPTED   = 130
+)
+
+// ExitError is an error that sets the exit code of the process
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
@@ -3,6 +3,7 @@ package util
 import (
 	"crypto/sha1"
 	"fmt"
+	"io"
 	"os"
 )
 
@@ -57,3 +58,17 @@ func QuickSHA1(path string) (string, error) {
 	h := s.Sum(nil)
 	return fmt.Sprintf("%x", h), nil
 }
+
+// SHA1 returns the hex encoded SHA1 of the complete contents of a file
+func SHA1(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s := sha1.New()
+	if _, err := io.Copy(s, f); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", s.Sum(nil)), nil
+}
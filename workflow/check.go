@@ -0,0 +1,184 @@
+package workflow
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/bmeg/lathe/scriptfile"
+)
+
+const (
+	ISSUE_ERROR   = "error"
+	ISSUE_WARNING = "warning"
+)
+
+// Issue is a problem with a plan found without running it
+type Issue struct {
+	Level   string `json:"level"`
+	Step    string `json:"step,omitempty"`
+	Source  string `json:"source,omitempty"`
+	Message string `json:"message"`
+}
+
+var mustacheRe = regexp.MustCompile(`\{\{\{?([^}]*)\}?\}\}`)
+var fileRefRe = regexp.MustCompile(`\b(inputs|outputs)(\.([A-Za-z0-9_]+))?`)
+
+// Check validates a workflow without running anything. It reports bad
+// Process fields, template references to undeclared files, inputs the command
+// never uses, missing executables and images, and file checks nothing reads.
+// If the workflow can not be built, that error is reported along with the
+// problems of each process
+func Check(wd *scriptfile.WorkflowDesc) []Issue {
+	out := []Issue{}
+	procs := []*WorkflowProcess{}
+	wf, err := PrepWorkflow(wd, nil)
+	if err != nil {
+		out = append(out, Issue{Level: ISSUE_ERROR, Source: wd.Source, Message: err.Error()})
+		wf = &Workflow{Steps: map[string]WorkflowStep{}, Report: NewRunReport()}
+		seen := map[*scriptfile.ProcessDesc]bool{}
+		for _, p := range wd.Steps {
+			if proc := p.GetProcess(); proc != nil && !seen[proc] {
+				seen[proc] = true
+				procs = append(procs, NewWorkflowProcess(wf, p.GetBasePath(), proc))
+			}
+		}
+	} else {
+		for _, s := range wf.Steps {
+			if ws, ok := s.(*WorkflowProcess); ok {
+				procs = append(procs, ws)
+			}
+		}
+	}
+	sort.SliceStable(procs, func(i, j int) bool { return procs[i].Desc.Name < procs[j].Desc.Name })
+	images := map[string]bool{}
+	for _, ws := range procs {
+		out = append(out, ws.check()...)
+		if ws.Desc.Image != "" {
+			images[ws.Desc.Image] = true
+		}
+	}
+	for _, i := range checkImages(images) {
+		i.Source = wd.Source
+		out = append(out, i)
+	}
+
+	//files declared with lathe.File that no process reads
+	read := map[string]bool{}
+	for _, ws := range procs {
+		for _, i := range ws.GetInputs() {
+			read[i.Abs()] = true
+		}
+	}
+	for _, p := range wd.Steps {
+		if p.GetProcess() == nil {
+			for _, path := range p.GetInputs() {
+				d := DataFile{BaseDir: filepath.Dir(p.GetBasePath()), RelPath: path}
+				if !read[d.Abs()] {
+					i := Issue{Level: ISSUE_WARNING, Source: wd.Source, Message: fmt.Sprintf("file check %s is not an input of any step", d.Abs())}
+					if fc, ok := p.(*scriptfile.FileCheck); ok && fc.File.Source != "" {
+						i.Source = fc.File.Source
+					}
+					out = append(out, i)
+				}
+			}
+		}
+	}
+	return out
+}
+
+func (ws *WorkflowProcess) issue(level string, format string, args ...any) Issue {
+	return Issue{Level: level, Step: ws.Desc.Name, Source: ws.Desc.Source, Message: fmt.Sprintf(format, args...)}
+}
+
+func (ws *WorkflowProcess) check() []Issue {
+	out := []Issue{}
+	for _, i := range ws.Desc.Issues {
+		out = append(out, ws.issue(ISSUE_ERROR, "%s", i))
+	}
+
+	//template references
+	refs := map[string]bool{}
+	wholeInputs := false
+	for _, t := range []string{ws.Desc.CommandLine, ws.Desc.Shell, ws.Desc.Stdin, ws.Desc.Stdout, ws.Desc.Stderr} {
+		for _, m := range mustacheRe.FindAllStringSubmatch(t, -1) {
+			for _, r := range fileRefRe.FindAllStringSubmatch(m[1], -1) {
+				if r[3] == "" {
+					if r[1] == "inputs" {
+						wholeInputs = true
+					}
+					continue
+				}
+				refs[r[1]+"."+r[3]] = true
+				files := ws.Desc.Inputs
+				if r[1] == "outputs" {
+					files = ws.Desc.Outputs
+				}
+				if _, ok := files[r[3]]; !ok {
+					out = append(out, ws.issue(ISSUE_ERROR, "template references {{%s.%s}}, which is not declared in %s", r[1], r[3], r[1]))
+				}
+			}
+		}
+	}
+
+	cmdLine, err := ws.commandLine()
+	if err != nil {
+		out = append(out, ws.issue(ISSUE_ERROR, "template error: %s", err))
+		return out
+	}
+	if _, err := ws.redirects(); err != nil {
+		out = append(out, ws.issue(ISSUE_ERROR, "template error: %s", err))
+	}
+
+	//inputs the command never mentions, by template or by path
+	if !wholeInputs && (ws.Desc.CommandLine != "" || ws.Desc.Shell != "") {
+		text := strings.Join(cmdLine, " ")
+		keys := []string{}
+		for k := range ws.Desc.Inputs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if !refs["inputs."+k] && !strings.Contains(text, ws.Desc.Inputs[k]) {
+				out = append(out, ws.issue(ISSUE_WARNING, "input '%s' is not used in the command", k))
+			}
+		}
+	}
+
+	//executables run outside of a container must be on the PATH
+	if len(cmdLine) > 0 && ws.Desc.Image == "" {
+		exe := cmdLine[0]
+		if strings.Contains(exe, "/") && !filepath.IsAbs(exe) {
+			exe = filepath.Join(ws.BaseDir, exe)
+		}
+		if _, err := exec.LookPath(exe); err != nil {
+			out = append(out, ws.issue(ISSUE_ERROR, "executable %s not found", cmdLine[0]))
+		}
+	}
+	return out
+}
+
+// checkImages reports the docker images that are not available locally
+func checkImages(images map[string]bool) []Issue {
+	out := []Issue{}
+	if len(images) == 0 {
+		return out
+	}
+	if _, err := exec.LookPath("docker"); err != nil {
+		return append(out, Issue{Level: ISSUE_ERROR, Message: "steps use docker images, but docker was not found"})
+	}
+	names := []string{}
+	for i := range images {
+		names = append(names, i)
+	}
+	sort.Strings(names)
+	for _, i := range names {
+		if err := exec.Command("docker", "image", "inspect", i).Run(); err != nil {
+			out = append(out, Issue{Level: ISSUE_WARNING, Message: fmt.Sprintf("image %s has not been built or pulled", i)})
+		}
+	}
+	return out
+}
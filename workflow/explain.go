@@ -0,0 +1,63 @@
+package workflow
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	DECISION_RUN     = "run"
+	DECISION_SKIP    = "skip"
+	DECISION_BLOCKED = "blocked"
+)
+
+// Explain writes the plan of a dry run: every process step in dependency
+// order with the decision made for it, the reason, the rendered command and
+// the resources it would request
+func (wf *Workflow) Explain(w io.Writer) error {
+	if err := wf.planTemps(); err != nil {
+		return err
+	}
+	states, err := wf.Status()
+	if err != nil {
+		return err
+	}
+	for i, st := range states {
+		ws := wf.Steps[st.Name].(*WorkflowProcess)
+		decision := DECISION_RUN
+		switch st.State {
+		case STATE_UP_TO_DATE:
+			decision = DECISION_SKIP
+		case STATE_BLOCKED, STATE_ERROR:
+			decision = DECISION_BLOCKED
+		}
+		reason := st.Reason
+		if reason == "" {
+			reason = st.State
+		}
+		fmt.Fprintf(w, "%d. %s: %s\n", i+1, st.Name, decision)
+		fmt.Fprintf(w, "   reason:    %s\n", reason)
+		if len(st.Command) > 0 {
+			fmt.Fprintf(w, "   command:   %s\n", strings.Join(st.Command, " "))
+		}
+		fmt.Fprintf(w, "   resources: %s\n", ws.resources())
+	}
+	return nil
+}
+
+// resources describes what the step requests from the runner
+func (ws *WorkflowProcess) resources() string {
+	out := []string{fmt.Sprintf("cpus=%d", ws.Desc.NCpus), fmt.Sprintf("memMB=%d", ws.Desc.MemMB)}
+	if ws.Desc.Image != "" {
+		out = append(out, "image="+ws.Desc.Image)
+	}
+	timeout := ws.Desc.Timeout
+	if timeout == 0 {
+		timeout = ws.Workflow.StepTimeout
+	}
+	if timeout != 0 {
+		out = append(out, "timeout="+timeout.String())
+	}
+	return strings.Join(out, " ")
+}
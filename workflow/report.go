@@ -0,0 +1,139 @@
+package workflow
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/bmeg/lathe/logger"
+)
+
+// Outcomes of the process steps of a run
+const (
+	OUTCOME_SUCCEEDED = "succeeded"
+	OUTCOME_SKIPPED   = "skipped"
+	OUTCOME_FAILED    = "failed"
+	OUTCOME_NOT_RUN   = "not-run"
+	OUTCOME_WOULD_RUN = "would-run"
+)
+
+// RunReport collects the outcome of every step of a workflow run
+type RunReport struct {
+	mutex         sync.Mutex
+	Outcomes      map[string]string
+	MissingInputs []string
+}
+
+func NewRunReport() *RunReport {
+	return &RunReport{Outcomes: map[string]string{}}
+}
+
+func (r *RunReport) setOutcome(name string, outcome string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.Outcomes[name] = outcome
+}
+
+func (r *RunReport) addMissingInput(path string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.MissingInputs = append(r.MissingInputs, path)
+}
+
+// Counts returns the number of process steps with each outcome. Steps that
+// never reported an outcome are counted as not run
+func (wf *Workflow) Counts() map[string]int {
+	wf.Report.mutex.Lock()
+	defer wf.Report.mutex.Unlock()
+	out := map[string]int{
+		OUTCOME_SUCCEEDED: 0,
+		OUTCOME_SKIPPED:   0,
+		OUTCOME_FAILED:    0,
+		OUTCOME_NOT_RUN:   0,
+	}
+	for name, s := range wf.Steps {
+		if _, ok := s.(*WorkflowProcess); ok {
+			if o, ok := wf.Report.Outcomes[name]; ok {
+				out[o]++
+			} else {
+				out[OUTCOME_NOT_RUN]++
+			}
+		}
+	}
+	return out
+}
+
+// Groups returns the process steps of each Scatter group
+func (wf *Workflow) Groups() map[string][]string {
+	out := map[string][]string{}
+	for name, s := range wf.Steps {
+		if ws, ok := s.(*WorkflowProcess); ok && ws.Desc.Group != "" {
+			out[ws.Desc.Group] = append(out[ws.Desc.Group], name)
+		}
+	}
+	for _, v := range out {
+		sort.Strings(v)
+	}
+	return out
+}
+
+// groupCounts returns the number of finished, failed and total steps of a group
+func (wf *Workflow) groupCounts(steps []string) (int, int) {
+	wf.Report.mutex.Lock()
+	defer wf.Report.mutex.Unlock()
+	done, failed := 0, 0
+	for _, n := range steps {
+		switch wf.Report.Outcomes[n] {
+		case OUTCOME_SUCCEEDED, OUTCOME_SKIPPED, OUTCOME_WOULD_RUN:
+			done++
+		case OUTCOME_FAILED, OUTCOME_NOT_RUN:
+			failed++
+		}
+	}
+	return done, failed
+}
+
+// groupProgress logs how many steps of a Scatter group have finished
+func (wf *Workflow) groupProgress(group string) {
+	steps := wf.Groups()[group]
+	done, failed := wf.groupCounts(steps)
+	msg := fmt.Sprintf("%s: %d/%d done", group, done, len(steps))
+	if failed > 0 {
+		msg = fmt.Sprintf("%s, %d failed or not run", msg, failed)
+	}
+	logger.Info(msg)
+}
+
+// stepFailed is called when a step fails. With FailFast set, it cancels all
+// outstanding work
+func (wf *Workflow) stepFailed(name string) {
+	if wf.FailFast && wf.cancel != nil {
+		logger.Error("Step failed, canceling workflow", "name", name)
+		wf.cancel()
+	}
+}
+
+// AddSummary adds the step counts of the run to the logger summary
+func (wf *Workflow) AddSummary(name string) {
+	args := []any{"workflow", name}
+	counts := wf.Counts()
+	for _, o := range []string{OUTCOME_SUCCEEDED, OUTCOME_SKIPPED, OUTCOME_FAILED, OUTCOME_NOT_RUN, OUTCOME_WOULD_RUN} {
+		if c, ok := counts[o]; ok {
+			args = append(args, o, c)
+		}
+	}
+	if len(wf.Report.MissingInputs) > 0 {
+		args = append(args, "missing-inputs", len(wf.Report.MissingInputs))
+	}
+	logger.AddSummaryInfo("Steps", args...)
+	groups := wf.Groups()
+	gNames := []string{}
+	for g := range groups {
+		gNames = append(gNames, g)
+	}
+	sort.Strings(gNames)
+	for _, g := range gNames {
+		done, failed := wf.groupCounts(groups[g])
+		logger.AddSummaryInfo("Group", "workflow", name, "group", g, "done", done, "failed", failed, "total", len(groups[g]))
+	}
+}
@@ -0,0 +1,291 @@
+package workflow
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bmeg/lathe/runner"
+	"github.com/bmeg/lathe/scriptfile"
+	"github.com/bmeg/lathe/state"
+)
+
+// shellProcess declares a shell step run in dir
+func shellProcess(dir string, name string, shell string, inputs map[string]string, outputs map[string]string) *scriptfile.ProcessDesc {
+	return &scriptfile.ProcessDesc{
+		Name: name, BasePath: dir, Shell: shell, Inputs: inputs, Outputs: outputs,
+		Dirs: map[string]bool{}, Temps: map[string]bool{}, NCpus: 1, MemMB: 1,
+	}
+}
+
+// testStore opens the state of a test workflow in dir, like a plan file in
+// dir would
+func testStore(t *testing.T, dir string) *state.Store {
+	t.Helper()
+	store, err := state.Open(filepath.Join(dir, ".lathe", "state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// testRun runs the processes as a workflow and returns it, so its outcomes
+// can be checked
+func testRun(t *testing.T, store *state.Store, mode string, procs []*scriptfile.ProcessDesc, setup func(*Workflow)) *Workflow {
+	t.Helper()
+	wd := &scriptfile.WorkflowDesc{Name: "test"}
+	for _, p := range procs {
+		wd.Steps = append(wd.Steps, p)
+	}
+	wf, err := PrepWorkflow(wd, runner.NewSingleMachineRunner(4, 4000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf.State = store
+	wf.CheckMode = mode
+	if setup != nil {
+		setup(wf)
+	}
+	fwf, err := wf.BuildFlame(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		fwf.ProcessIn <- &WorkflowStatus{Name: "run"}
+		close(fwf.ProcessIn)
+	}()
+	fwf.Workflow.Start()
+	fwf.Workflow.Wait()
+	wf.CleanStaging()
+	return wf
+}
+
+func expectOutcomes(t *testing.T, run string, wf *Workflow, want map[string]string) {
+	t.Helper()
+	for name, outcome := range want {
+		if got := wf.Report.Outcomes[name]; got != outcome {
+			t.Errorf("%s: step %s %s, want %s", run, name, got, outcome)
+		}
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestStderrKeptOnFailure(t *testing.T) {
+	for _, mode := range []string{CHECK_HASH, CHECK_MTIME} {
+		dir := t.TempDir()
+		load := shellProcess(dir, "load", "echo loading >&2; test -f ok", nil, nil)
+		load.Stderr = "load.err"
+		procs := []*scriptfile.ProcessDesc{load}
+		store := testStore(t, dir)
+
+		wf := testRun(t, store, mode, procs, nil)
+		expectOutcomes(t, mode+" first run", wf, map[string]string{"load": OUTCOME_FAILED})
+		if got := readFile(t, filepath.Join(dir, "load.err")); got != "loading\n" {
+			t.Errorf("%s: stderr of the failed step is %q", mode, got)
+		}
+
+		//the kept stderr file must not make the failed step look up to date
+		wf = testRun(t, store, mode, procs, nil)
+		expectOutcomes(t, mode+" rerun", wf, map[string]string{"load": OUTCOME_FAILED})
+		states, err := wf.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if states[0].State == STATE_UP_TO_DATE {
+			t.Errorf("%s: failed step reported up to date: %s", mode, states[0].Reason)
+		}
+
+		os.WriteFile(filepath.Join(dir, "ok"), nil, 0644)
+		wf = testRun(t, store, mode, procs, nil)
+		expectOutcomes(t, mode+" fixed run", wf, map[string]string{"load": OUTCOME_SUCCEEDED})
+		wf = testRun(t, store, mode, procs, nil)
+		expectOutcomes(t, mode+" last run", wf, map[string]string{"load": OUTCOME_SKIPPED})
+	}
+}
+
+func TestRetries(t *testing.T) {
+	dir := t.TempDir()
+	store := testStore(t, dir)
+	//fails twice, writing a partial output each time, which must be gone
+	//before the next attempt
+	flaky := shellProcess(dir, "flaky", "test ! -e out.txt || exit 9; echo x >> count; echo part > {{outputs.o}}; test $(wc -l < count) -ge 3 || exit 2", nil, map[string]string{"o": "out.txt"})
+	flaky.Retries = 2
+	wf := testRun(t, store, CHECK_HASH, []*scriptfile.ProcessDesc{flaky}, nil)
+	expectOutcomes(t, "retried run", wf, map[string]string{"flaky": OUTCOME_SUCCEEDED})
+	if got := readFile(t, filepath.Join(dir, "count")); got != "x\nx\nx\n" {
+		t.Errorf("expected 3 attempts, got %q", got)
+	}
+
+	cases := []struct {
+		name     string
+		retries  uint
+		retryOn  []int
+		attempts string
+	}{
+		{"out of retries", 1, nil, "x\nx\n"},
+		{"exit code not retried", 3, []int{4}, "x\n"},
+		{"exit code retried", 2, []int{2}, "x\nx\nx\n"},
+	}
+	for _, c := range cases {
+		dir := t.TempDir()
+		p := shellProcess(dir, "fail", "echo x >> count; exit 2", nil, map[string]string{"o": "out.txt"})
+		p.Retries = c.retries
+		p.RetryOn = c.retryOn
+		wf := testRun(t, testStore(t, dir), CHECK_HASH, []*scriptfile.ProcessDesc{p}, nil)
+		expectOutcomes(t, c.name, wf, map[string]string{"fail": OUTCOME_FAILED})
+		if got := readFile(t, filepath.Join(dir, "count")); got != c.attempts {
+			t.Errorf("%s: attempts %q, want %q", c.name, got, c.attempts)
+		}
+	}
+}
+
+func TestTempChain(t *testing.T) {
+	for _, mode := range []string{CHECK_HASH, CHECK_MTIME} {
+		dir := t.TempDir()
+		store := testStore(t, dir)
+		os.WriteFile(filepath.Join(dir, "in.txt"), []byte("1\n"), 0644)
+		unpack := shellProcess(dir, "unpack", "cat {{inputs.i}} {{inputs.i}} > {{outputs.big}}", map[string]string{"i": "in.txt"}, map[string]string{"big": "big.txt"})
+		unpack.Temps["big.txt"] = true
+		count := shellProcess(dir, "count", "wc -l < {{inputs.big}} > {{outputs.o}}", map[string]string{"big": "big.txt"}, map[string]string{"o": "count.txt"})
+		procs := []*scriptfile.ProcessDesc{unpack, count}
+
+		wf := testRun(t, store, mode, procs, nil)
+		expectOutcomes(t, mode+" first run", wf, map[string]string{"unpack": OUTCOME_SUCCEEDED, "count": OUTCOME_SUCCEEDED})
+		if PathExists(filepath.Join(dir, "big.txt")) {
+			t.Errorf("%s: temporary output was not removed", mode)
+		}
+
+		//the deleted temporary output must not make either step stale
+		wf = testRun(t, store, mode, procs, nil)
+		expectOutcomes(t, mode+" second run", wf, map[string]string{"unpack": OUTCOME_SKIPPED, "count": OUTCOME_SKIPPED})
+		states, err := wf.Status()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range states {
+			if s.State != STATE_UP_TO_DATE {
+				t.Errorf("%s: %s is %s: %s", mode, s.Name, s.State, s.Reason)
+			}
+		}
+
+		//a consumer that needs to run gets the temporary output regenerated
+		os.Remove(filepath.Join(dir, "count.txt"))
+		wf = testRun(t, store, mode, procs, nil)
+		expectOutcomes(t, mode+" regenerate", wf, map[string]string{"unpack": OUTCOME_SUCCEEDED, "count": OUTCOME_SUCCEEDED})
+		if got := readFile(t, filepath.Join(dir, "count.txt")); got != "2\n" {
+			t.Errorf("%s: count is %q", mode, got)
+		}
+
+		//a changed input reruns the chain
+		os.WriteFile(filepath.Join(dir, "in.txt"), []byte("1\n2\n"), 0644)
+		future := time.Now().Add(time.Minute)
+		os.Chtimes(filepath.Join(dir, "in.txt"), future, future)
+		wf = testRun(t, store, mode, procs, nil)
+		expectOutcomes(t, mode+" changed input", wf, map[string]string{"unpack": OUTCOME_SUCCEEDED, "count": OUTCOME_SUCCEEDED})
+		if got := readFile(t, filepath.Join(dir, "count.txt")); got != "4\n" {
+			t.Errorf("%s: count is %q after the input changed", mode, got)
+		}
+	}
+}
+
+func TestAtomicOutputs(t *testing.T) {
+	dir := t.TempDir()
+	store := testStore(t, dir)
+	os.WriteFile(filepath.Join(dir, "ver"), []byte("1"), 0644)
+	p := shellProcess(dir, "a", "echo started >&2; echo v$(cat {{inputs.v}}) > {{outputs.o}}; test ! -f fail", map[string]string{"v": "ver"}, map[string]string{"o": "out/a.txt"})
+	p.Atomic = true
+	p.Stderr = "a.err"
+	os.MkdirAll(filepath.Join(dir, "out"), 0755)
+	procs := []*scriptfile.ProcessDesc{p}
+
+	//files left by an interrupted run are cleared
+	leftover := filepath.Join(dir, "out", STAGING_DIR, "a", "a.txt")
+	os.MkdirAll(filepath.Dir(leftover), 0755)
+	os.WriteFile(leftover, []byte("partial"), 0644)
+
+	wf := testRun(t, store, CHECK_HASH, procs, nil)
+	expectOutcomes(t, "first run", wf, map[string]string{"a": OUTCOME_SUCCEEDED})
+	if got := readFile(t, filepath.Join(dir, "out", "a.txt")); got != "v1\n" {
+		t.Errorf("output is %q", got)
+	}
+	if PathExists(filepath.Join(dir, "out", STAGING_DIR)) {
+		t.Errorf("staging directory was not removed")
+	}
+
+	//a failed run leaves the previous output, and its stderr
+	os.WriteFile(filepath.Join(dir, "ver"), []byte("2"), 0644)
+	os.WriteFile(filepath.Join(dir, "fail"), nil, 0644)
+	wf = testRun(t, store, CHECK_HASH, procs, nil)
+	expectOutcomes(t, "failed run", wf, map[string]string{"a": OUTCOME_FAILED})
+	if got := readFile(t, filepath.Join(dir, "out", "a.txt")); got != "v1\n" {
+		t.Errorf("output after a failure is %q", got)
+	}
+	if got := readFile(t, filepath.Join(dir, "a.err")); got != "started\n" {
+		t.Errorf("stderr after a failure is %q", got)
+	}
+	if PathExists(filepath.Join(dir, "out", STAGING_DIR)) {
+		t.Errorf("staging directory was not removed after a failure")
+	}
+
+	os.Remove(filepath.Join(dir, "fail"))
+	wf = testRun(t, store, CHECK_HASH, procs, nil)
+	expectOutcomes(t, "fixed run", wf, map[string]string{"a": OUTCOME_SUCCEEDED})
+	if got := readFile(t, filepath.Join(dir, "out", "a.txt")); got != "v2\n" {
+		t.Errorf("output after the fix is %q", got)
+	}
+}
+
+func TestAtomicSharedDir(t *testing.T) {
+	dir := t.TempDir()
+	store := testStore(t, dir)
+	procs := []*scriptfile.ProcessDesc{}
+	for i := 0; i < 24; i++ {
+		p := shellProcess(dir, fmt.Sprintf("s%d", i), "echo x > {{outputs.o}}", nil, map[string]string{"o": fmt.Sprintf("out/%d.txt", i)})
+		procs = append(procs, p)
+	}
+	wf := testRun(t, store, CHECK_HASH, procs, func(wf *Workflow) { wf.AtomicOutputs = true })
+	for _, p := range procs {
+		expectOutcomes(t, "shared staging directory", wf, map[string]string{p.Name: OUTCOME_SUCCEEDED})
+	}
+	if PathExists(filepath.Join(dir, "out", STAGING_DIR)) {
+		t.Errorf("staging directory was not removed")
+	}
+}
+
+func TestStagingDirKeptDuringRun(t *testing.T) {
+	dir := t.TempDir()
+	wf := &Workflow{Steps: map[string]WorkflowStep{}}
+	p := shellProcess(dir, "a", "true", nil, map[string]string{"o": "out/a.txt"})
+	p.Atomic = true
+	ws := NewWorkflowProcess(wf, dir, p)
+	wf.Steps["a"] = ws
+	shared := filepath.Join(dir, "out", STAGING_DIR)
+
+	if err := ws.prepStaging(); err != nil {
+		t.Fatal(err)
+	}
+	ws.removeStaging()
+	//another step may be creating its staging directory in the shared one
+	if !PathExists(shared) {
+		t.Errorf("shared staging directory removed while the workflow is running")
+	}
+	if PathExists(ws.stagingDir(filepath.Join(dir, "out"))) {
+		t.Errorf("staging directory of the step was not removed")
+	}
+	wf.CleanStaging()
+	if PathExists(shared) {
+		t.Errorf("shared staging directory not removed at the end of the run")
+	}
+}
@@ -0,0 +1,102 @@
+package workflow
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// STAGING_DIR is the directory, next to each output, that atomic steps write
+// their outputs to before they are renamed into place
+const STAGING_DIR = ".lathe-staging"
+
+// atomic checks if the step writes its outputs to a staging location
+func (ws *WorkflowProcess) atomic() bool {
+	return ws.Desc.Atomic || ws.Workflow.AtomicOutputs
+}
+
+// stagingDir is the staging directory of the step for outputs in dir. It is
+// on the same filesystem as the outputs, so they can be renamed into place
+func (ws *WorkflowProcess) stagingDir(dir string) string {
+	return filepath.Join(dir, STAGING_DIR, SafeFileName(ws.Desc.Name))
+}
+
+// stagePath is where the command writes the output path when staging
+func (ws *WorkflowProcess) stagePath(p string) string {
+	p = filepath.Clean(p)
+	return filepath.Join(ws.stagingDir(filepath.Dir(p)), filepath.Base(p))
+}
+
+// commandOutputs are the paths the command writes: the staged outputs of
+// atomic steps, except for the stderr redirect, otherwise the outputs
+// themselves
+func (ws *WorkflowProcess) commandOutputs() map[string]DataFile {
+	out := ws.GetOutputs()
+	if !ws.atomic() {
+		return out
+	}
+	for k, v := range out {
+		if !ws.isStderr(v) {
+			v.RelPath = ws.stagePath(v.RelPath)
+			out[k] = v
+		}
+	}
+	return out
+}
+
+// prepStaging removes what an earlier, interrupted, run left in the staging
+// directories of the step and creates them again
+func (ws *WorkflowProcess) prepStaging() error {
+	ws.removeStaging()
+	for _, o := range ws.GetOutputs() {
+		if err := os.MkdirAll(ws.stagingDir(filepath.Dir(filepath.Clean(o.Abs()))), 0755); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStaging deletes the staging directories of the step. The shared
+// staging directory is left for CleanStaging, as other steps may be using it
+func (ws *WorkflowProcess) removeStaging() {
+	for _, o := range ws.GetOutputs() {
+		os.RemoveAll(ws.stagingDir(filepath.Dir(filepath.Clean(o.Abs()))))
+	}
+}
+
+// CleanStaging removes the shared staging directories of atomic steps that
+// are empty, once the workflow has finished running
+func (wf *Workflow) CleanStaging() {
+	for _, s := range wf.Steps {
+		if ws, ok := s.(*WorkflowProcess); ok && ws.atomic() {
+			for _, o := range ws.GetOutputs() {
+				os.Remove(filepath.Join(filepath.Dir(filepath.Clean(o.Abs())), STAGING_DIR))
+			}
+		}
+	}
+}
+
+// commitStaging renames the staged outputs into place, replacing the old
+// ones, then removes the staging directories
+func (ws *WorkflowProcess) commitStaging() error {
+	defer ws.removeStaging()
+	for _, o := range ws.GetOutputs() {
+		if ws.isStderr(o) {
+			continue
+		}
+		dst := filepath.Clean(o.Abs())
+		src := ws.stagePath(dst)
+		if o.Dir && PathExists(dst) && !IsFile(dst) {
+			if !safeToRemove(dst, ws.BaseDir) {
+				return fmt.Errorf("refusing to replace directory output %s", dst)
+			}
+			if err := os.RemoveAll(dst); err != nil {
+				return err
+			}
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+	}
+	return nil
+}
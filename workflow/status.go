@@ -0,0 +1,154 @@
+package workflow
+
+import (
+	"fmt"
+	"sort"
+)
+
+const (
+	STATE_UP_TO_DATE = "up-to-date"
+	STATE_STALE      = "stale"
+	STATE_BLOCKED    = "blocked"
+	STATE_NEVER_RUN  = "never-run"
+	STATE_ERROR      = "error"
+)
+
+// StepState is the predicted state of a process step, found without running anything
+type StepState struct {
+	Name   string `json:"name"`
+	State  string `json:"state"`
+	Reason string `json:"reason,omitempty"`
+	// Source is the plan file and line that declared the step
+	Source string `json:"source,omitempty"`
+	// Command is the rendered command line, process steps only
+	Command []string `json:"command,omitempty"`
+}
+
+// TopoSort returns the step names ordered so every step comes after the steps
+// it depends on. Steps at the same depth are sorted by name
+func (wf *Workflow) TopoSort() ([]string, error) {
+	inDegree := map[string]int{}
+	rdeps := map[string][]string{}
+	for n := range wf.Steps {
+		inDegree[n] = 0
+	}
+	for n, deps := range wf.DepMap {
+		for _, d := range deps {
+			if _, ok := wf.Steps[d]; ok {
+				inDegree[n]++
+				rdeps[d] = append(rdeps[d], n)
+			}
+		}
+	}
+	ready := []string{}
+	for n, c := range inDegree {
+		if c == 0 {
+			ready = append(ready, n)
+		}
+	}
+	out := []string{}
+	for len(ready) > 0 {
+		sort.Strings(ready)
+		next := []string{}
+		for _, n := range ready {
+			out = append(out, n)
+			for _, r := range rdeps[n] {
+				inDegree[r]--
+				if inDegree[r] == 0 {
+					next = append(next, r)
+				}
+			}
+		}
+		ready = next
+	}
+	if len(out) != len(wf.Steps) {
+		if err := wf.CheckCycles(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("workflow steps can not be ordered")
+	}
+	return out, nil
+}
+
+// Status walks the workflow in dependency order and applies the same
+// up-to-date checks as a run, without executing any commands
+func (wf *Workflow) Status() ([]StepState, error) {
+	order, err := wf.TopoSort()
+	if err != nil {
+		return nil, err
+	}
+	states := map[string]StepState{}
+	out := []StepState{}
+	for _, n := range order {
+		st := StepState{Name: n, State: STATE_UP_TO_DATE}
+		switch s := wf.Steps[n].(type) {
+		case *WorkflowFileCheck:
+			if !PathExists(s.File.Abs()) {
+				st.State = STATE_BLOCKED
+				st.Reason = fmt.Sprintf("missing input %s", s.File.Abs())
+			}
+			states[n] = st
+			continue
+		case *WorkflowProcess:
+			st = s.status(states)
+		}
+		states[n] = st
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+// status predicts the state of the step, given the states of the steps before it
+func (ws *WorkflowProcess) status(states map[string]StepState) StepState {
+	st := StepState{Name: ws.Desc.Name, State: STATE_UP_TO_DATE, Source: ws.Desc.Source}
+	deps := append([]string{}, ws.Workflow.DepMap[ws.Desc.Name]...)
+	sort.Strings(deps)
+	cmdLine, err := ws.commandLine()
+	if err == nil {
+		_, err = ws.redirects()
+	}
+	if err != nil {
+		st.State = STATE_ERROR
+		st.Reason = fmt.Sprintf("template error: %s", err)
+		return st
+	}
+	st.Command = cmdLine
+	for _, d := range deps {
+		if ds, ok := states[d]; ok && (ds.State == STATE_BLOCKED || ds.State == STATE_ERROR) {
+			st.State = STATE_BLOCKED
+			if ds.State == STATE_BLOCKED && ds.Reason != "" {
+				st.Reason = ds.Reason
+			} else {
+				st.Reason = fmt.Sprintf("upstream step %s", d)
+			}
+			return st
+		}
+	}
+	upstream := ""
+	for _, d := range deps {
+		if ds, ok := states[d]; ok && (ds.State == STATE_STALE || ds.State == STATE_NEVER_RUN) {
+			upstream = d
+			break
+		}
+	}
+	if ws.Workflow.State != nil {
+		if rec, _ := ws.Workflow.State.GetStep(ws.Desc.Name); rec == nil {
+			if check := ws.isStale(cmdLine, upstream != ""); check.Run {
+				st.State = STATE_NEVER_RUN
+				st.Reason = check.Reason
+				return st
+			}
+		}
+	}
+	if upstream != "" {
+		st.State = STATE_STALE
+		st.Reason = fmt.Sprintf("upstream step %s is stale", upstream)
+		return st
+	}
+	check := ws.isStale(cmdLine, false)
+	if check.Run {
+		st.State = STATE_STALE
+	}
+	st.Reason = check.Reason
+	return st
+}
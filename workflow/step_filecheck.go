@@ -1,6 +1,7 @@
 package workflow
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/bmeg/flame"
@@ -10,10 +11,13 @@ import (
 /*****/
 
 type WorkflowFileCheck struct {
-	File DataFile
+	File     DataFile
+	Workflow *Workflow
+	// Source is where the file was declared, if it was declared with lathe.File
+	Source string
 }
 
-func (ws *WorkflowFileCheck) Process(key string, status []*WorkflowStatus) flame.KeyValue[string, *WorkflowStatus] {
+func (ws *WorkflowFileCheck) Process(ctx context.Context, key string, status []*WorkflowStatus) flame.KeyValue[string, *WorkflowStatus] {
 	dryRun := false
 	for _, i := range status {
 		if i.Status != STATUS_OK {
@@ -27,8 +31,15 @@ func (ws *WorkflowFileCheck) Process(key string, status []*WorkflowStatus) flame
 	logger.Debug("Checking for file\n", "path", ws.File.Abs())
 	if !PathExists(ws.File.Abs()) {
 		output.Status = STATUS_FAIL
-		logger.Error("Missing file", "path", ws.File.Abs())
-		logger.AddSummaryError("Missing file", "path", ws.File.Abs())
+		if ws.Source != "" {
+			logger.Error("Missing file", "path", ws.File.Abs(), "source", ws.Source)
+			logger.AddSummaryError("Missing file", "path", ws.File.Abs(), "source", ws.Source)
+		} else {
+			logger.Error("Missing file", "path", ws.File.Abs())
+			logger.AddSummaryError("Missing file", "path", ws.File.Abs())
+		}
+		ws.Workflow.Report.addMissingInput(ws.File.Abs())
+		ws.Workflow.stepFailed(ws.GetName())
 	} else {
 		output.Status = STATUS_OK
 	}
@@ -54,6 +65,10 @@ func (ws *WorkflowFileCheck) GetName() string {
 	return ws.File.Abs()
 }
 
+func (ws *WorkflowFileCheck) GetSource() string {
+	return ws.Source
+}
+
 func (ws *WorkflowFileCheck) GetDesc() string {
 	return fmt.Sprintf("check-file: %s", ws.File.Abs())
 }
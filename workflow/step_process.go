@@ -1,8 +1,12 @@
 package workflow
 
 import (
+	"context"
+	"crypto/sha1"
+	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/aymerick/raymond"
@@ -10,17 +14,20 @@ import (
 	"github.com/bmeg/lathe/logger"
 	"github.com/bmeg/lathe/runner"
 	"github.com/bmeg/lathe/scriptfile"
+	"github.com/bmeg/lathe/state"
 	"github.com/google/shlex"
 )
 
 type WorkflowStep interface {
 	GetName() string
 	IsGenerator() bool
-	Process(key string, status []*WorkflowStatus) flame.KeyValue[string, *WorkflowStatus]
+	Process(ctx context.Context, key string, status []*WorkflowStatus) flame.KeyValue[string, *WorkflowStatus]
 	GetInputs() map[string]DataFile
 	GetOutputs() map[string]DataFile
 
 	GetDesc() string
+	// GetSource returns the plan file and line that declared the step, if known
+	GetSource() string
 }
 
 /*****/
@@ -35,19 +42,30 @@ func NewWorkflowProcess(wf *Workflow, baseDir string, desc *scriptfile.ProcessDe
 	return &WorkflowProcess{BaseDir: baseDir, Desc: desc, Workflow: wf}
 }
 
-func (ws *WorkflowProcess) Process(key string, status []*WorkflowStatus) flame.KeyValue[string, *WorkflowStatus] {
+func (ws *WorkflowProcess) Process(ctx context.Context, key string, status []*WorkflowStatus) flame.KeyValue[string, *WorkflowStatus] {
+	if ctx.Err() != nil {
+		logger.Info("Workflow canceled, not running", "name", ws.Desc.Name)
+		ws.setOutcome(OUTCOME_NOT_RUN)
+		return flame.KeyValue[string, *WorkflowStatus]{Key: key, Value: &WorkflowStatus{Status: STATUS_CANCELED}}
+	}
 	logger.Info("Process", "name", ws.Desc.Name)
 	dryRun := false
+	invalidated := false
 	for _, i := range status {
 		if i.Status != STATUS_OK {
 			logger.Info("Received upstream FAIL, skipping", "name", ws.Desc.Name)
+			ws.setOutcome(OUTCOME_NOT_RUN)
 			return flame.KeyValue[string, *WorkflowStatus]{Key: key, Value: i}
 		}
 		if i.DryRun {
 			dryRun = true
 		}
+		if i.Invalidated {
+			invalidated = true
+		}
 	}
 	output := &WorkflowStatus{DryRun: dryRun}
+	outcome := OUTCOME_FAILED
 	outputsFound := 0
 	notFound := []string{}
 	for _, o := range ws.GetOutputs() {
@@ -58,80 +76,35 @@ func (ws *WorkflowProcess) Process(key string, status []*WorkflowStatus) flame.K
 		}
 	}
 
-	cmdInputs := map[string]any{}
-	cmdOutputs := map[string]any{}
-
-	for k, v := range ws.Desc.Inputs {
-		cmdInputs[k] = v
-	}
-
-	for k, v := range ws.Desc.Outputs {
-		cmdOutputs[k] = v
-	}
-
-	cmdParams := map[string]any{
-		"inputs":  cmdInputs,
-		"outputs": cmdOutputs,
-	}
-
-	cmdLine := []string{}
 	output.Status = STATUS_OK
+	cmdLine, err := ws.commandLine()
+	if err != nil {
+		logger.Error("Template error", "error", err)
+		output.Status = STATUS_FAIL
+	}
 
-	if ws.Desc.CommandLine != "" {
-		commandLineBase := ws.Desc.CommandLine
-		commandLineText, err := raymond.Render(commandLineBase, cmdParams)
-		if err != nil {
-			logger.Error("Template error", "error", err)
-			output.Status = STATUS_FAIL
-		}
-		if output.Status != STATUS_FAIL {
-			cmdLine, err = shlex.Split(commandLineText)
-			if err != nil {
-				logger.Error("Template error", "error", err)
-				output.Status = STATUS_FAIL
-			}
-		}
-	} else if ws.Desc.Shell != "" {
-		commandLineBase := ws.Desc.Shell
-		commandLineText, err := raymond.Render(commandLineBase, cmdParams)
-		if err != nil {
-			logger.Error("Template error", "error", err)
-			output.Status = STATUS_FAIL
-		}
-		if output.Status != STATUS_FAIL {
-			cmdLine = []string{"bash", "-c", commandLineText}
-		}
+	redirects, err := ws.redirects()
+	if err != nil {
+		logger.Error("Template error", "error", err)
+		output.Status = STATUS_FAIL
 	}
 
 	if output.Status != STATUS_FAIL {
-		doRun := true
-		if outputsFound == len(ws.GetOutputs()) {
-
-			var outputDate time.Time
-			for _, o := range ws.GetOutputs() {
-				i, err := os.Stat(o.Abs())
-				if err == nil {
-					if i.ModTime().After(outputDate) {
-						outputDate = i.ModTime()
-					}
-				}
-			}
-
-			var inputDate time.Time
-			for _, o := range ws.GetInputs() {
-				i, err := os.Stat(o.Abs())
-				if err == nil {
-					if i.ModTime().After(inputDate) {
-						inputDate = i.ModTime()
-					}
-				}
-			}
-			if outputDate.Before(inputDate) {
-				logger.Info("Output files outdated, running command", "inputDate", inputDate, "outputDate", outputDate, "outputsRequired", ws.GetOutputs(), "commandLine", cmdLine)
-			} else {
-				logger.Info("Skipping command", "outputsFound", outputsFound, "outputsRequired", ws.GetOutputs(), "commandLine", cmdLine)
-				output.Status = STATUS_OK
-				doRun = false
+		check := ws.isStale(cmdLine, invalidated)
+		if check.Run && len(ws.products()) == 0 {
+			//without outputs, dependents can only see that this step ran through invalidation
+			check.Invalidated = true
+		}
+		doRun := check.Run
+		output.Invalidated = check.Invalidated
+		if doRun {
+			logger.Info("Output files outdated, running command", "reason", check.Reason, "outputsFound", outputsFound, "outputsRequired", ws.GetOutputs(), "commandLine", cmdLine)
+		} else {
+			logger.Info("Skipping command", "reason", check.Reason, "outputsFound", outputsFound, "outputsRequired", ws.GetOutputs(), "commandLine", cmdLine)
+			output.Status = STATUS_OK
+			outcome = OUTCOME_SKIPPED
+			if !dryRun && !ws.Workflow.Assume[ws.Desc.Name] {
+				ws.adoptState(cmdLine)
 			}
 		}
 		if doRun {
@@ -139,54 +112,423 @@ func (ws *WorkflowProcess) Process(key string, status []*WorkflowStatus) flame.K
 				//fmt.Printf("Running command: %s missing outputs: (%s)\n", cmdLine, strings.Join(notFound, ","))
 				inputs := []string{}
 				outputs := []string{}
-				for _, v := range ws.Desc.Inputs {
-					inputs = append(inputs, v)
+				for _, v := range ws.GetInputs() {
+					inputs = append(inputs, v.RelPath)
 				}
-				for _, v := range ws.Desc.Outputs {
-					outputs = append(outputs, v)
+				for _, v := range ws.commandOutputs() {
+					outputs = append(outputs, v.RelPath)
+				}
+				runCmdLine := cmdLine
+				if ws.atomic() {
+					runCmdLine, redirects, err = ws.stagedCommand()
+					if err == nil {
+						err = ws.prepStaging()
+					}
+					if err != nil {
+						logger.Error("Staging error", "name", ws.Desc.Name, "error", err)
+						logger.AddSummaryError("Staging error", "name", ws.Desc.Name, "error", err)
+						ws.setOutcome(OUTCOME_FAILED)
+						ws.Workflow.stepFailed(ws.Desc.Name)
+						return flame.KeyValue[string, *WorkflowStatus]{Key: key, Value: &WorkflowStatus{Status: STATUS_FAIL}}
+					}
 				}
 				toolCmd := runner.CommandLineTool{
-					CommandLine: cmdLine,
+					CommandLine: runCmdLine,
 					BaseDir:     ws.BaseDir,
 					MemMB:       ws.Desc.MemMB,
 					NCpus:       ws.Desc.NCpus,
 					Image:       ws.Desc.Image,
 					Inputs:      inputs,
 					Outputs:     outputs,
+					Stdin:       redirects["stdin"],
+					Stdout:      redirects["stdout"],
+					Stderr:      redirects["stderr"],
+					Timeout:     ws.Desc.Timeout,
+				}
+				if toolCmd.Timeout == 0 {
+					toolCmd.Timeout = ws.Workflow.StepTimeout
 				}
-				_, err := ws.Workflow.Runner.RunCommand(&toolCmd)
+				if ws.Workflow.LogDir != "" {
+					toolCmd.LogPrefix = filepath.Join(ws.Workflow.LogDir, SafeFileName(ws.Desc.Name))
+				}
+				attempts, err := ws.runAttempts(ctx, &toolCmd)
+				cmdLog := attempts[len(attempts)-1]
 				if err == nil {
-					for k, v := range ws.GetOutputs() {
+					for k, v := range ws.commandOutputs() {
 						if !PathExists(v.Abs()) {
 							logger.Error("Missing output", "commandLine", cmdLine, "name", k, "path", v.Abs())
 							output.Status = STATUS_FAIL
 							logger.AddSummaryError("Missing output", "commandLine", cmdLine, "name", k, "path", v.Abs())
 						}
 					}
+					if output.Status == STATUS_OK && ws.atomic() {
+						if err := ws.commitStaging(); err != nil {
+							logger.Error("Unable to move staged outputs into place", "name", ws.Desc.Name, "error", err)
+							logger.AddSummaryError("Staging error", "name", ws.Desc.Name, "error", err)
+							output.Status = STATUS_FAIL
+						}
+					} else if output.Status != STATUS_OK && ws.atomic() {
+						ws.cleanOutputs()
+						ws.removeStaging()
+					}
 					if output.Status == STATUS_OK {
-						logger.Info("Command suceeded", "commandLine", cmdLine)
+						logger.Info("Command suceeded", "commandLine", cmdLine, "wallTime", cmdLog.WallTime)
+						ws.recordState(cmdLine)
+						outcome = OUTCOME_SUCCEEDED
 					}
 				} else {
 					output.Status = STATUS_FAIL
-					logger.AddSummaryError("CommandFailed", "commandLine", cmdLine)
-					//The command failed, so outputs might be partially completed. Delete them for safety
-					//TODO: setup command line option to turn this off
-					for _, i := range ws.GetOutputs() {
-						if IsFile(i.Abs()) {
-							os.Remove(i.Abs())
-						}
+					failure := "CommandFailed"
+					if cmdLog.TimedOut {
+						output.Status = STATUS_TIMEOUT
+						failure = "CommandTimedOut"
+						logger.Error("Command timed out", "name", ws.Desc.Name, "timeout", toolCmd.Timeout)
+					} else if cmdLog.Canceled {
+						output.Status = STATUS_CANCELED
+						failure = "CommandCanceled"
+						outcome = OUTCOME_NOT_RUN
+					}
+					logger.AddSummaryErrorLog(failure, cmdLog.StderrPath, "name", ws.Desc.Name, "commandLine", cmdLine, "exitCode", cmdLog.ExitCode, "attempts", len(attempts), "wallTime", cmdLog.WallTime, "stderr", cmdLog.StderrPath)
+					ws.cleanOutputs()
+					if ws.atomic() {
+						ws.removeStaging()
 					}
 				}
 			} else {
-				logger.Info("Would run command: %s %#v\n", cmdLine, cmdParams)
+				logger.Info("Would run command", "commandLine", cmdLine)
 				output.Status = STATUS_OK
+				outcome = OUTCOME_WOULD_RUN
+			}
+		}
+	}
+
+	ws.setOutcome(outcome)
+	if outcome == OUTCOME_FAILED {
+		ws.Workflow.stepFailed(ws.Desc.Name)
+		if len(ws.products()) == 0 && !dryRun && ws.Workflow.State != nil {
+			//nothing left on disk shows the failure, so forget the last success
+			if err := ws.Workflow.State.DeleteStep(ws.Desc.Name); err != nil {
+				logger.Error("State write error", "name", ws.Desc.Name, "error", err)
 			}
 		}
 	}
+	if outcome == OUTCOME_SUCCEEDED || (outcome == OUTCOME_SKIPPED && !dryRun) {
+		ws.Workflow.releaseTemps(ws)
+	}
 
 	return flame.KeyValue[string, *WorkflowStatus]{Key: key, Value: output}
 }
 
+// runAttempts runs the command, retrying failed attempts as configured by the
+// process, with the delay doubling after each attempt. Partial outputs are
+// removed between attempts. Returns the log of every attempt
+func (ws *WorkflowProcess) runAttempts(ctx context.Context, toolCmd *runner.CommandLineTool) ([]*runner.CommandLog, error) {
+	logPrefix := toolCmd.LogPrefix
+	attempts := []*runner.CommandLog{}
+	for attempt := 1; ; attempt++ {
+		if logPrefix != "" && attempt > 1 {
+			toolCmd.LogPrefix = fmt.Sprintf("%s.%d", logPrefix, attempt)
+		}
+		cmdLog, err := ws.Workflow.Runner.RunCommand(ctx, toolCmd)
+		if cmdLog == nil {
+			cmdLog = &runner.CommandLog{ExitCode: -1}
+		}
+		cmdLog.Attempt = attempt
+		attempts = append(attempts, cmdLog)
+		if err == nil || cmdLog.Canceled || attempt > int(ws.Desc.Retries) || !ws.retryable(cmdLog) {
+			return attempts, err
+		}
+		delay := ws.Desc.RetryDelay * time.Duration(1<<min(attempt-1, 16))
+		logger.Info("Command failed, retrying", "name", ws.Desc.Name, "attempt", attempt, "exitCode", cmdLog.ExitCode, "delay", delay)
+		logger.AddSummaryWarning("CommandRetried", "name", ws.Desc.Name, "attempt", attempt, "exitCode", cmdLog.ExitCode, "stderr", cmdLog.StderrPath)
+		ws.cleanOutputs()
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// retryable checks if a failed attempt should be retried. If the process lists
+// no retryOn exit codes, every failure is retried
+func (ws *WorkflowProcess) retryable(cmdLog *runner.CommandLog) bool {
+	if len(ws.Desc.RetryOn) == 0 {
+		return true
+	}
+	for _, c := range ws.Desc.RetryOn {
+		if c == cmdLog.ExitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// cleanOutputs removes the outputs of a failed command, which might be
+// partially completed. If the workflow has a QuarantineDir, they are moved
+// there instead. Atomic steps only clean their staged outputs. The stderr
+// redirect is kept, as it explains the failure
+func (ws *WorkflowProcess) cleanOutputs() {
+	for _, i := range ws.commandOutputs() {
+		if ws.isStderr(i) {
+			continue
+		}
+		if i.Dir && PathExists(i.Abs()) && !IsFile(i.Abs()) {
+			if !safeToRemove(i.Abs(), ws.BaseDir) {
+				logger.Error("Refusing to remove directory output", "name", ws.Desc.Name, "path", i.Abs())
+				continue
+			}
+			if ws.Workflow.QuarantineDir != "" {
+				dst := filepath.Join(ws.Workflow.QuarantineDir, SafeFileName(ws.Desc.Name), filepath.Base(i.Abs()))
+				if err := moveFile(i.Abs(), dst); err == nil {
+					logger.Info("Quarantined partial output", "path", i.Abs(), "quarantine", dst)
+					continue
+				} else {
+					logger.Error("Unable to quarantine partial output, removing", "path", i.Abs(), "error", err)
+				}
+			}
+			if err := os.RemoveAll(i.Abs()); err != nil {
+				logger.Error("Unable to remove directory output", "path", i.Abs(), "error", err)
+			}
+		} else if IsFile(i.Abs()) {
+			if ws.Workflow.QuarantineDir != "" {
+				dst := filepath.Join(ws.Workflow.QuarantineDir, SafeFileName(ws.Desc.Name), filepath.Base(i.Abs()))
+				if err := moveFile(i.Abs(), dst); err == nil {
+					logger.Info("Quarantined partial output", "path", i.Abs(), "quarantine", dst)
+					continue
+				} else {
+					logger.Error("Unable to quarantine partial output, removing", "path", i.Abs(), "error", err)
+				}
+			}
+			os.Remove(i.Abs())
+		}
+	}
+}
+
+// staleCheck is the decision about whether a step needs to be run. Invalidated
+// is set when the decision should also force the dependent steps to run
+type staleCheck struct {
+	Run         bool
+	Invalidated bool
+	Reason      string
+}
+
+// isStale determines if the step needs to be run, and why
+func (ws *WorkflowProcess) isStale(cmdLine []string, upstreamInvalidated bool) staleCheck {
+	if ws.Workflow.Force[ws.Desc.Name] {
+		if r, ok := ws.Workflow.ForceReasons[ws.Desc.Name]; ok {
+			return staleCheck{Run: true, Reason: r}
+		}
+		return staleCheck{Run: true, Reason: "forced"}
+	}
+	if ws.Workflow.Assume[ws.Desc.Name] {
+		missing := false
+		for _, o := range ws.products() {
+			if ws.outputMissing(o) {
+				missing = true
+			}
+		}
+		if !missing {
+			return staleCheck{Run: false, Reason: "assumed up to date"}
+		}
+	}
+	if upstreamInvalidated {
+		return staleCheck{Run: true, Invalidated: true, Reason: "upstream step invalidated"}
+	}
+	for _, o := range ws.products() {
+		if ws.outputMissing(o) {
+			return staleCheck{Run: true, Reason: fmt.Sprintf("missing output %s", o.Abs())}
+		}
+	}
+	var rec *state.StepRecord
+	if ws.Workflow.State != nil {
+		var err error
+		rec, err = ws.Workflow.State.GetStep(ws.Desc.Name)
+		if err != nil {
+			logger.Error("State read error", "name", ws.Desc.Name, "error", err)
+		}
+	}
+	if len(ws.products()) == 0 && rec == nil {
+		return staleCheck{Run: true, Reason: "no outputs and no recorded run"}
+	}
+	if rec != nil && rec.Signature != ws.signature(cmdLine) {
+		return staleCheck{Run: true, Invalidated: true, Reason: "process definition changed"}
+	}
+	if ws.Workflow.CheckMode == CHECK_HASH {
+		if rec != nil && rec.Mode == CHECK_HASH {
+			return ws.hashStale(rec)
+		}
+		logger.Debug("No recorded hashes, checking modification times", "name", ws.Desc.Name)
+	}
+	return ws.mtimeStale(rec)
+}
+
+// outputMissing checks if an output does not exist, other than a temporary
+// output that was deleted on purpose
+func (ws *WorkflowProcess) outputMissing(o DataFile) bool {
+	return !PathExists(o.Abs()) && !(o.Temp && ws.Workflow.tempDeleted(o.Abs()))
+}
+
+// mtimeStale compares the newest input modification time to the newest output.
+// Steps without outputs use the time of their last recorded run instead
+func (ws *WorkflowProcess) mtimeStale(rec *state.StepRecord) staleCheck {
+	var outputDate time.Time
+	outputPath := "last recorded run"
+	if len(ws.products()) == 0 && rec != nil {
+		outputDate = rec.Time
+	}
+	for _, o := range ws.products() {
+		i, err := state.StatFile(o.Abs())
+		if rec != nil && ws.Workflow.tempDeleted(o.Abs()) {
+			//a deleted temporary output counts with the time it was recorded at
+			i, err = state.FileRecord{ModTime: rec.Time}, nil
+			if r, ok := rec.Outputs[o.Abs()]; ok {
+				i = r
+			}
+		}
+		if err == nil {
+			if i.ModTime.After(outputDate) {
+				outputDate = i.ModTime
+				outputPath = o.Abs()
+			}
+		}
+	}
+
+	var inputDate time.Time
+	inputPath := ""
+	for _, o := range ws.GetInputs() {
+		i, err := state.StatFile(o.Abs())
+		if err == nil {
+			if i.ModTime.After(inputDate) {
+				inputDate = i.ModTime
+				inputPath = o.Abs()
+			}
+		}
+	}
+	if outputDate.Before(inputDate) {
+		return staleCheck{Run: true, Reason: fmt.Sprintf("input %s (%s) newer than %s (%s)", inputPath, inputDate.Format(time.RFC3339), outputPath, outputDate.Format(time.RFC3339))}
+	}
+	return staleCheck{Reason: "outputs newer than inputs"}
+}
+
+// hashStale compares the current content hashes of the inputs and outputs to
+// those recorded after the last successful run
+func (ws *WorkflowProcess) hashStale(rec *state.StepRecord) staleCheck {
+	inputs := ws.GetInputs()
+	if len(inputs) != len(rec.Inputs) {
+		return staleCheck{Run: true, Reason: "inputs changed"}
+	}
+	for _, i := range inputs {
+		if changed, reason := ws.fileChanged(i.Abs(), rec.Inputs); changed {
+			return staleCheck{Run: true, Reason: "input " + reason}
+		}
+	}
+	for _, o := range ws.products() {
+		if changed, reason := ws.fileChanged(o.Abs(), rec.Outputs); changed {
+			return staleCheck{Run: true, Reason: "output " + reason}
+		}
+	}
+	return staleCheck{Reason: "content hashes unchanged"}
+}
+
+func (ws *WorkflowProcess) fileChanged(path string, recorded map[string]state.FileRecord) (bool, string) {
+	if ws.Workflow.tempDeleted(path) {
+		return false, ""
+	}
+	prev, ok := recorded[path]
+	if !ok {
+		return true, fmt.Sprintf("%s not recorded", path)
+	}
+	cur, err := ws.Workflow.State.HashFile(path)
+	if err != nil {
+		return true, fmt.Sprintf("%s unreadable: %s", path, err)
+	}
+	if cur.Hash != prev.Hash {
+		return true, fmt.Sprintf("%s changed", path)
+	}
+	return false, ""
+}
+
+// recordState saves the signature of the step and the state of its inputs and
+// outputs after a successful run. Content hashes are only computed in hash mode
+func (ws *WorkflowProcess) recordState(cmdLine []string) {
+	if ws.Workflow.State == nil {
+		return
+	}
+	rec := &state.StepRecord{
+		Name:      ws.Desc.Name,
+		Signature: ws.signature(cmdLine),
+		Mode:      ws.Workflow.CheckMode,
+		Inputs:    map[string]state.FileRecord{},
+		Outputs:   map[string]state.FileRecord{},
+	}
+	fileRecord := state.StatFile
+	if ws.Workflow.CheckMode == CHECK_HASH {
+		fileRecord = ws.Workflow.State.HashFile
+	}
+	for _, i := range ws.GetInputs() {
+		if r, err := fileRecord(i.Abs()); err == nil {
+			rec.Inputs[i.Abs()] = r
+		}
+	}
+	for _, o := range ws.products() {
+		if r, err := fileRecord(o.Abs()); err == nil {
+			rec.Outputs[o.Abs()] = r
+		}
+	}
+	if err := ws.Workflow.State.PutStep(rec); err != nil {
+		logger.Error("State write error", "name", ws.Desc.Name, "error", err)
+	}
+}
+
+// adoptState records the state of an up to date step that has no record, or
+// only a modification time record while in hash mode, so later runs have a
+// baseline to compare to
+func (ws *WorkflowProcess) adoptState(cmdLine []string) {
+	if ws.Workflow.State == nil {
+		return
+	}
+	rec, _ := ws.Workflow.State.GetStep(ws.Desc.Name)
+	if rec == nil || (ws.Workflow.CheckMode == CHECK_HASH && rec.Mode != CHECK_HASH) {
+		ws.recordState(cmdLine)
+	}
+}
+
+// signature identifies everything about the process definition that affects
+// its outputs: the command templates, the rendered command line, the image
+// and the requested resources
+func (ws *WorkflowProcess) signature(cmdLine []string) string {
+	sig := map[string]any{
+		"commandLine": ws.Desc.CommandLine,
+		"shell":       ws.Desc.Shell,
+		"rendered":    cmdLine,
+		"stdin":       ws.Desc.Stdin,
+		"stdout":      ws.Desc.Stdout,
+		"stderr":      ws.Desc.Stderr,
+		"image":       ws.Desc.Image,
+		"memMB":       ws.Desc.MemMB,
+		"ncpus":       ws.Desc.NCpus,
+	}
+	data, _ := json.Marshal(sig)
+	return fmt.Sprintf("%x", sha1.Sum(data))
+}
+
+// setOutcome records the outcome of the step, and logs the progress of its
+// Scatter group
+func (ws *WorkflowProcess) setOutcome(outcome string) {
+	ws.Workflow.Report.setOutcome(ws.Desc.Name, outcome)
+	if ws.Desc.Group != "" {
+		ws.Workflow.groupProgress(ws.Desc.Group)
+	}
+}
+
+// describe names the step, and where it was declared, for error messages
+func (ws *WorkflowProcess) describe() string {
+	if ws.Desc.Source == "" {
+		return fmt.Sprintf("step %s", ws.Desc.Name)
+	}
+	return fmt.Sprintf("step %s (%s)", ws.Desc.Name, ws.Desc.Source)
+}
+
 func (ws *WorkflowProcess) GetName() string {
 	return ws.Desc.Name
 }
@@ -195,10 +537,121 @@ func (ws *WorkflowProcess) IsGenerator() bool {
 	return len(ws.GetInputs()) == 0
 }
 
+// commandLine renders the command line, or shell script, of the step
+func (ws *WorkflowProcess) commandLine() ([]string, error) {
+	return ws.renderCommand(ws.templateParams())
+}
+
+// stagedCommand renders the command line and redirects of an atomic step,
+// with the outputs pointing at their staging paths. The stderr redirect is
+// written in place, so it survives a failure
+func (ws *WorkflowProcess) stagedCommand() ([]string, map[string]string, error) {
+	params := ws.templateParams()
+	cmdOutputs := map[string]any{}
+	for k, v := range ws.Desc.Outputs {
+		if ws.isStderr(DataFile{BaseDir: ws.BaseDir, RelPath: v}) {
+			cmdOutputs[k] = v
+		} else {
+			cmdOutputs[k] = ws.stagePath(v)
+		}
+	}
+	params["outputs"] = cmdOutputs
+	cmdLine, err := ws.renderCommand(params)
+	if err != nil {
+		return nil, nil, err
+	}
+	redirects, err := ws.redirects()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p, ok := redirects["stdout"]; ok {
+		redirects["stdout"] = ws.stagePath(p)
+	}
+	return cmdLine, redirects, nil
+}
+
+func (ws *WorkflowProcess) renderCommand(cmdParams map[string]any) ([]string, error) {
+	if ws.Desc.CommandLine != "" {
+		commandLineText, err := raymond.Render(ws.Desc.CommandLine, cmdParams)
+		if err != nil {
+			return nil, err
+		}
+		return shlex.Split(commandLineText)
+	} else if ws.Desc.Shell != "" {
+		commandLineText, err := raymond.Render(ws.Desc.Shell, cmdParams)
+		if err != nil {
+			return nil, err
+		}
+		return []string{"bash", "-c", commandLineText}, nil
+	}
+	return []string{}, nil
+}
+
+// templateParams are the values available to the handlebars templates of
+// the command line and redirects
+func (ws *WorkflowProcess) templateParams() map[string]any {
+	cmdInputs := map[string]any{}
+	cmdOutputs := map[string]any{}
+
+	for k, v := range ws.Desc.Inputs {
+		cmdInputs[k] = v
+	}
+
+	for k, v := range ws.Desc.Outputs {
+		cmdOutputs[k] = v
+	}
+
+	cmdWildcards := map[string]any{}
+	for k, v := range ws.Desc.Wildcards {
+		cmdWildcards[k] = v
+	}
+
+	return map[string]any{
+		"inputs":    cmdInputs,
+		"outputs":   cmdOutputs,
+		"wildcards": cmdWildcards,
+	}
+}
+
+// redirects renders the stdin, stdout and stderr templates of the process
+func (ws *WorkflowProcess) redirects() (map[string]string, error) {
+	out := map[string]string{}
+	params := ws.templateParams()
+	for k, v := range map[string]string{"stdin": ws.Desc.Stdin, "stdout": ws.Desc.Stdout, "stderr": ws.Desc.Stderr} {
+		if v != "" {
+			r, err := raymond.Render(v, params)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", k, err)
+			}
+			out[k] = r
+		}
+	}
+	return out, nil
+}
+
+// addRedirect adds a redirect file to a set of inputs or outputs, unless the
+// path is already declared
+func addRedirect(files map[string]DataFile, key string, file DataFile) {
+	for _, f := range files {
+		if f.Abs() == file.Abs() {
+			return
+		}
+	}
+	for _, ok := files[key]; ok; _, ok = files[key] {
+		key = "_" + key
+	}
+	files[key] = file
+}
+
 func (ws *WorkflowProcess) GetInputs() map[string]DataFile {
 	out := map[string]DataFile{}
 	for k, v := range ws.Desc.Inputs {
-		out[k] = DataFile{BaseDir: ws.BaseDir, RelPath: v}
+		out[k] = DataFile{BaseDir: ws.BaseDir, RelPath: v, Dir: ws.Desc.Dirs[v]}
+	}
+	if r, err := ws.redirects(); err == nil {
+		if p, ok := r["stdin"]; ok {
+			addRedirect(out, "stdin", DataFile{BaseDir: ws.BaseDir, RelPath: p})
+		}
 	}
 	return out
 }
@@ -206,11 +659,45 @@ func (ws *WorkflowProcess) GetInputs() map[string]DataFile {
 func (ws *WorkflowProcess) GetOutputs() map[string]DataFile {
 	out := map[string]DataFile{}
 	for k, v := range ws.Desc.Outputs {
-		out[k] = DataFile{BaseDir: ws.BaseDir, RelPath: v}
+		out[k] = DataFile{BaseDir: ws.BaseDir, RelPath: v, Dir: ws.Desc.Dirs[v], Temp: ws.Desc.Temps[v]}
+	}
+	if r, err := ws.redirects(); err == nil {
+		for _, k := range []string{"stdout", "stderr"} {
+			if p, ok := r[k]; ok {
+				addRedirect(out, k, DataFile{BaseDir: ws.BaseDir, RelPath: p})
+			}
+		}
 	}
 	return out
 }
 
+// products are the outputs that show the step has run, used to decide if it
+// is up to date: every output but the stderr redirect, which is written even
+// when the command fails
+func (ws *WorkflowProcess) products() map[string]DataFile {
+	out := ws.GetOutputs()
+	for k, v := range out {
+		if ws.isStderr(v) {
+			delete(out, k)
+		}
+	}
+	return out
+}
+
+// isStderr checks if an output is the stderr redirect of the step
+func (ws *WorkflowProcess) isStderr(f DataFile) bool {
+	r, err := ws.redirects()
+	if err != nil || r["stderr"] == "" {
+		return false
+	}
+	e := DataFile{BaseDir: ws.BaseDir, RelPath: r["stderr"]}
+	return filepath.Clean(e.Abs()) == filepath.Clean(f.Abs())
+}
+
+func (ws *WorkflowProcess) GetSource() string {
+	return ws.Desc.Source
+}
+
 func (ws *WorkflowProcess) GetDesc() string {
 	return fmt.Sprintf("run: %s", ws.Desc.CommandLine)
 }
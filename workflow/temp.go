@@ -0,0 +1,129 @@
+package workflow
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/bmeg/lathe/logger"
+)
+
+// tempOutput returns the step that produces path, if path is one of its
+// temporary outputs
+func (wf *Workflow) tempOutput(path string) *WorkflowProcess {
+	p, ok := wf.OutFileMap[path].(*WorkflowProcess)
+	if !ok {
+		return nil
+	}
+	for _, o := range p.GetOutputs() {
+		if o.Temp && o.Abs() == path {
+			return p
+		}
+	}
+	return nil
+}
+
+// tempDeleted checks if path is a temporary output that was removed after the
+// steps using it finished, rather than one that has gone missing
+func (wf *Workflow) tempDeleted(path string) bool {
+	p := wf.tempOutput(path)
+	if p == nil || wf.State == nil || PathExists(path) {
+		return false
+	}
+	rec, err := wf.State.GetStep(p.Desc.Name)
+	if err != nil || rec == nil {
+		return false
+	}
+	return rec.Outputs[path].Deleted
+}
+
+// consumers returns the process steps that have path as an input
+func (wf *Workflow) consumers(path string) []*WorkflowProcess {
+	out := []*WorkflowProcess{}
+	for _, s := range wf.Steps {
+		if ws, ok := s.(*WorkflowProcess); ok {
+			for _, i := range ws.GetInputs() {
+				if i.Abs() == path {
+					out = append(out, ws)
+					break
+				}
+			}
+		}
+	}
+	return out
+}
+
+// releaseTemps is called after a step succeeds or is skipped. Temporary
+// inputs of the step are deleted once every step using them has done so
+func (wf *Workflow) releaseTemps(ws *WorkflowProcess) {
+	wf.tempMutex.Lock()
+	defer wf.tempMutex.Unlock()
+	for _, i := range ws.GetInputs() {
+		path := i.Abs()
+		p := wf.tempOutput(path)
+		if p == nil || !PathExists(path) {
+			continue
+		}
+		done := true
+		wf.Report.mutex.Lock()
+		for _, c := range wf.consumers(path) {
+			if o := wf.Report.Outcomes[c.Desc.Name]; o != OUTCOME_SUCCEEDED && o != OUTCOME_SKIPPED {
+				done = false
+			}
+		}
+		wf.Report.mutex.Unlock()
+		if !done {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Error("Unable to remove temporary output", "path", path, "error", err)
+			continue
+		}
+		logger.Info("Removed temporary output", "name", p.Desc.Name, "path", path)
+		if wf.State != nil {
+			if err := wf.State.MarkDeleted(p.Desc.Name, path); err != nil {
+				logger.Error("State write error", "name", p.Desc.Name, "error", err)
+			}
+		}
+	}
+}
+
+// planTemps finds the steps whose deleted temporary outputs are needed again,
+// because a step using them is going to run, and forces them to run as well
+func (wf *Workflow) planTemps() error {
+	hasTemps := false
+	for _, s := range wf.Steps {
+		if ws, ok := s.(*WorkflowProcess); ok && len(ws.Desc.Temps) > 0 {
+			hasTemps = true
+		}
+	}
+	if !hasTemps || wf.State == nil {
+		return nil
+	}
+	states, err := wf.Status()
+	if err != nil {
+		return err
+	}
+	if wf.Force == nil {
+		wf.Force = map[string]bool{}
+	}
+	if wf.ForceReasons == nil {
+		wf.ForceReasons = map[string]string{}
+	}
+	var regen func(ws *WorkflowProcess)
+	regen = func(ws *WorkflowProcess) {
+		for _, i := range ws.GetInputs() {
+			if p := wf.tempOutput(i.Abs()); p != nil && !wf.Force[p.Desc.Name] && wf.tempDeleted(i.Abs()) {
+				logger.Info("Regenerating temporary output", "name", p.Desc.Name, "path", i.Abs(), "neededBy", ws.Desc.Name)
+				wf.Force[p.Desc.Name] = true
+				wf.ForceReasons[p.Desc.Name] = fmt.Sprintf("temporary output %s needed by %s", i.Abs(), ws.Desc.Name)
+				regen(p)
+			}
+		}
+	}
+	for _, st := range states {
+		if st.State == STATE_STALE || st.State == STATE_NEVER_RUN {
+			regen(wf.Steps[st.Name].(*WorkflowProcess))
+		}
+	}
+	return nil
+}
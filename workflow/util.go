@@ -3,6 +3,10 @@ package workflow
 import (
 	"errors"
 	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
 )
 
 func PathExists(path string) bool {
@@ -17,3 +21,51 @@ func IsFile(path string) bool {
 	}
 	return !s.IsDir()
 }
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// SafeFileName converts a step name, which may contain path separators, into
+// a string that can be used as a file name
+func SafeFileName(name string) string {
+	return unsafeFileChars.ReplaceAllString(name, "_")
+}
+
+// matchName matches a step name against a glob pattern, like path.Match
+// but with '*' and '?' also matching '/', which appears in the names of
+// scattered steps, like 'count:data/a.tsv'
+func matchName(pattern string, name string) (bool, error) {
+	return path.Match(strings.ReplaceAll(pattern, "/", "\x00"), strings.ReplaceAll(name, "/", "\x00"))
+}
+
+// safeToRemove checks that a directory output can be deleted: it must not be
+// the root, the working directory of the step, or a directory containing it
+func safeToRemove(path string, baseDir string) bool {
+	path = filepath.Clean(path)
+	if path == filepath.Dir(path) {
+		return false
+	}
+	base, err := filepath.Abs(baseDir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(path, base)
+	if err != nil {
+		return false
+	}
+	//base is path, or inside it
+	if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+		return false
+	}
+	if home, err := os.UserHomeDir(); err == nil && filepath.Clean(home) == path {
+		return false
+	}
+	return true
+}
+
+// moveFile renames a file, creating the destination directory
+func moveFile(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
@@ -0,0 +1,31 @@
+package workflow
+
+import "testing"
+
+func TestMatchName(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"count:*", "count:data/a.tsv", true},
+		{"count:*.tsv", "count:data/sub/a.tsv", true},
+		{"count:data/?.tsv", "count:data/a.tsv", true},
+		{"count:data/*", "count:data/a.tsv", true},
+		{"count:*", "counts", false},
+		{"download*", "download", true},
+		{"download", "download2", false},
+		{"*:a.tsv", "count:data/a.tsv", false},
+	}
+	for _, c := range cases {
+		m, err := matchName(c.pattern, c.name)
+		if err != nil {
+			t.Errorf("%s: %s", c.pattern, err)
+		} else if m != c.want {
+			t.Errorf("matchName(%q, %q) = %v, want %v", c.pattern, c.name, m, c.want)
+		}
+	}
+	if _, err := matchName("[a", "a"); err == nil {
+		t.Errorf("expected error for a bad pattern")
+	}
+}
@@ -1,29 +1,51 @@
 package workflow
 
 import (
+	"context"
 	"fmt"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bmeg/flame"
 	"github.com/bmeg/lathe/logger"
 	"github.com/bmeg/lathe/runner"
 	"github.com/bmeg/lathe/scriptfile"
+	"github.com/bmeg/lathe/state"
 )
 
 const (
-	STATUS_OK   = 0
-	STATUS_FAIL = 1
+	STATUS_OK       = 0
+	STATUS_FAIL     = 1
+	STATUS_TIMEOUT  = 2
+	STATUS_CANCELED = 3
 )
 
+// Methods used to decide if a step's outputs are up to date
+const (
+	CHECK_MTIME = "mtime"
+	CHECK_HASH  = "hash"
+)
+
+// WorkflowStatus is passed from each step to its dependents. Invalidated is set
+// when the step was run because its process definition changed, or because an
+// upstream step was invalidated, and forces the dependents to run as well
 type WorkflowStatus struct {
-	Name   string
-	Status int
-	DryRun bool
+	Name        string
+	Status      int
+	DryRun      bool
+	Invalidated bool
 }
 
 type DataFile struct {
 	BaseDir string
 	RelPath string
+	// Dir is set for paths declared with lathe.Dir
+	Dir bool
+	// Temp is set for temporary outputs
+	Temp bool
 }
 
 func (df *DataFile) Abs() string {
@@ -37,11 +59,140 @@ func (df *DataFile) Abs() string {
 
 /*****/
 
+// Workflow is the DAG of steps. DepMap lists the steps each step depends on.
+// AfterMap holds the subset of those edges that were declared explicitly, with
+// DependsOn or 'after', rather than found by matching files
 type Workflow struct {
-	Steps  map[string]WorkflowStep
-	DepMap map[string][]string
+	Steps      map[string]WorkflowStep
+	DepMap     map[string][]string
+	AfterMap   map[string][]string
+	OutFileMap map[string]WorkflowStep
 
 	Runner runner.CommandRunner
+
+	State     *state.Store
+	CheckMode string
+	// LogDir is where the stdout and stderr of each step are written, output
+	// is discarded if empty
+	LogDir string
+	// StepTimeout is the timeout of steps that do not set their own, no
+	// limit if zero
+	StepTimeout time.Duration
+	// QuarantineDir is where the partial outputs of failed or canceled steps
+	// are moved to. They are deleted if empty
+	QuarantineDir string
+	// FailFast cancels all outstanding work after the first failed step,
+	// otherwise independent branches keep going
+	FailFast bool
+	// AtomicOutputs stages the outputs of every step, as if they all set
+	// 'atomic'
+	AtomicOutputs bool
+	// Force lists the steps that are run regardless of their recorded state
+	Force map[string]bool
+	// ForceReasons explains why a step was forced, when it was not requested
+	ForceReasons map[string]string
+	// Assume lists the steps that are treated as up to date as long as
+	// their outputs exist
+	Assume map[string]bool
+
+	Report *RunReport
+	cancel context.CancelFunc
+	rules  []*scriptfile.RuleDesc
+
+	tempMutex sync.Mutex
+}
+
+// maxRuleDepth limits how deep rule instances can chain, to stop patterns
+// that match their own inputs
+const maxRuleDepth = 100
+
+// connect adds the dependencies of a step on the steps producing its inputs.
+// Inputs that match a rule's output pattern get a new step from that rule,
+// which is connected in turn, and other inputs get a file check
+func (wf *Workflow) connect(p WorkflowStep, depth int) error {
+	inputs := p.GetInputs()
+	keys := []string{}
+	for k := range inputs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		path := inputs[k]
+		inPath := path.Abs()
+		if inS := wf.producer(inPath); inS != nil {
+			if inS != p {
+				wf.AddDepends(p, inS)
+			}
+			continue
+		}
+		rs, err := wf.ruleStep(inPath, depth)
+		if err != nil {
+			return err
+		}
+		if rs != nil {
+			wf.AddDepends(p, rs)
+			continue
+		}
+		logger.Debug("File Check", "path", inPath)
+		if x, ok := wf.Steps[inPath].(*WorkflowFileCheck); ok {
+			wf.AddDepends(p, x)
+		} else {
+			s := &WorkflowFileCheck{File: path, Workflow: wf}
+			if err := wf.AddStep(s); err != nil {
+				logger.Error("FileCheckError", "error", err)
+			}
+			wf.AddDepends(p, s)
+		}
+	}
+	return nil
+}
+
+// producer returns the step that outputs path, or outputs a directory that
+// contains it
+func (wf *Workflow) producer(path string) WorkflowStep {
+	if s, ok := wf.OutFileMap[path]; ok {
+		return s
+	}
+	for p := filepath.Dir(path); p != filepath.Dir(p); p = filepath.Dir(p) {
+		if s, ok := wf.OutFileMap[p]; ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// ruleStep creates, and connects, the step for the first rule with an output
+// pattern matching path. It returns nil if no rule matches
+func (wf *Workflow) ruleStep(path string, depth int) (WorkflowStep, error) {
+	for _, r := range wf.rules {
+		wildcards, ok := r.Match(path)
+		if !ok {
+			continue
+		}
+		if depth >= maxRuleDepth {
+			return nil, fmt.Errorf("rule %s (%s): too many nested rule steps resolving %s", r.Name, r.Source, path)
+		}
+		proc := r.Instantiate(wildcards)
+		if s, ok := wf.Steps[proc.Name]; ok {
+			return s, nil
+		}
+		logger.Debug("Rule step", "rule", r.Name, "name", proc.Name, "path", path)
+		ws := NewWorkflowProcess(wf, proc.BasePath, proc)
+		if err := wf.AddStep(ws); err != nil {
+			return nil, err
+		}
+		for _, o := range ws.GetOutputs() {
+			if prev, ok := wf.OutFileMap[o.Abs()].(*WorkflowProcess); ok && prev != ws {
+				return nil, fmt.Errorf("output %s is declared by %s and %s", o.Abs(), prev.describe(), ws.describe())
+			}
+			wf.OutFileMap[o.Abs()] = ws
+		}
+		if err := wf.connect(ws, depth+1); err != nil {
+			return nil, err
+		}
+		return ws, nil
+	}
+	return nil, nil
 }
 
 func (w *Workflow) AddStep(ws WorkflowStep) error {
@@ -56,6 +207,9 @@ func (w *Workflow) AddStep(ws WorkflowStep) error {
 func (w *Workflow) AddDepends(step WorkflowStep, dep WorkflowStep) error {
 	stepName := step.GetName()
 	depName := dep.GetName()
+	if w.dependsOn(stepName, depName) {
+		return nil
+	}
 	if x, ok := w.DepMap[stepName]; ok {
 		w.DepMap[stepName] = append(x, depName)
 	} else {
@@ -69,17 +223,27 @@ func (w *Workflow) AddDepends(step WorkflowStep, dep WorkflowStep) error {
 func PrepWorkflow(wd *scriptfile.WorkflowDesc, run runner.CommandRunner) (*Workflow, error) {
 	logger.Info("Building Workflow DAG")
 	wf := &Workflow{
-		Steps:  map[string]WorkflowStep{},
-		DepMap: make(map[string][]string),
-		Runner: run,
+		Steps:     map[string]WorkflowStep{},
+		DepMap:    make(map[string][]string),
+		AfterMap:  make(map[string][]string),
+		Runner:    run,
+		CheckMode: CHECK_MTIME,
+		Report:    NewRunReport(),
 	}
 
 	//map inputs and outputs
 	inFileMap := map[string]WorkflowStep{}
 	outFileMap := map[string]WorkflowStep{}
+	wf.OutFileMap = outFileMap
 	for _, p := range wd.Steps {
 		if proc := p.GetProcess(); proc != nil {
 			ws := NewWorkflowProcess(wf, p.GetBasePath(), proc)
+			if prev, ok := wf.Steps[ws.GetName()].(*WorkflowProcess); ok {
+				if prev.Desc == proc {
+					continue
+				}
+				return nil, fmt.Errorf("non-unique step name: %s and %s", prev.describe(), ws.describe())
+			}
 			if err := wf.AddStep(ws); err != nil {
 				logger.Error("AddStepError", "error", err)
 			}
@@ -87,6 +251,12 @@ func PrepWorkflow(wd *scriptfile.WorkflowDesc, run runner.CommandRunner) (*Workf
 				inFileMap[path.Abs()] = ws
 			}
 			for _, path := range ws.GetOutputs() {
+				if prev, ok := outFileMap[path.Abs()].(*WorkflowProcess); ok && prev != ws {
+					return nil, fmt.Errorf("output %s is declared by %s and %s", path.Abs(), prev.describe(), ws.describe())
+				}
+				if inFileMap[path.Abs()] == ws {
+					return nil, fmt.Errorf("%s declares %s as both input and output", ws.describe(), path.Abs())
+				}
 				outFileMap[path.Abs()] = ws
 			}
 		} else {
@@ -96,7 +266,10 @@ func PrepWorkflow(wd *scriptfile.WorkflowDesc, run runner.CommandRunner) (*Workf
 					BaseDir: filepath.Dir(p.GetBasePath()),
 					RelPath: path,
 				}
-				s := &WorkflowFileCheck{d}
+				s := &WorkflowFileCheck{File: d, Workflow: wf}
+				if fc, ok := p.(*scriptfile.FileCheck); ok {
+					s.Source = fc.File.Source
+				}
 				if err := wf.AddStep(s); err != nil {
 					logger.Error("AddStepError", "error", err)
 				}
@@ -107,31 +280,315 @@ func PrepWorkflow(wd *scriptfile.WorkflowDesc, run runner.CommandRunner) (*Workf
 	//fmt.Printf("InfileMap: %#v\n", inFileMap)
 	//fmt.Printf("OutfileMap: %#v\n", outFileMap)
 
-	//connect inputs to existing outputs
-	fileSteps := map[string]WorkflowStep{}
+	//connect inputs to existing outputs, creating steps from rules and file
+	//checks for the inputs no step produces
+	wf.rules = wd.Rules
+	names := []string{}
+	for n := range wf.Steps {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		if err := wf.connect(wf.Steps[n], 0); err != nil {
+			return nil, err
+		}
+	}
+
+	//connect explicit dependencies
 	for _, p := range wf.Steps {
-		for _, path := range p.GetInputs() {
-			if inS, ok := outFileMap[path.Abs()]; ok {
-				wf.AddDepends(p, inS)
-			} else {
-				logger.Debug("File Check", "path", path.Abs())
-				inPath := path.Abs()
-				if x, ok := fileSteps[inPath]; ok {
-					wf.AddDepends(p, x)
-				} else {
-					lPath := path
-					s := &WorkflowFileCheck{lPath}
-					fileSteps[inPath] = s
-					if err := wf.AddStep(s); err != nil {
-						logger.Error("FileCheckError", "error", err)
+		if ws, ok := p.(*WorkflowProcess); ok {
+			if err := wf.connectAfter(ws); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := wf.CheckCycles(); err != nil {
+		return nil, err
+	}
+	return wf, nil
+}
+
+// connectAfter adds the dependencies a step declares explicitly, with
+// DependsOn or 'after'
+func (wf *Workflow) connectAfter(ws *WorkflowProcess) error {
+	depNames := append([]string{}, ws.Desc.AfterNames...)
+	for _, d := range ws.Desc.After {
+		depNames = append(depNames, d.Name)
+	}
+	for _, d := range depNames {
+		dep, ok := wf.Steps[d]
+		if !ok || d == "" {
+			return fmt.Errorf("%s depends on a process that is not in the workflow: '%s'", ws.describe(), d)
+		}
+		if !wf.dependsOn(ws.GetName(), d) {
+			wf.AddDepends(ws, dep)
+			wf.AfterMap[ws.GetName()] = append(wf.AfterMap[ws.GetName()], d)
+		}
+	}
+	return nil
+}
+
+// CheckCycles returns an error describing the first dependency cycle found,
+// as the chain of steps and the files that connect them
+func (w *Workflow) CheckCycles() error {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	names := []string{}
+	for n := range w.Steps {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	color := map[string]int{}
+	stack := []string{}
+	var cycle []string
+	var visit func(n string) bool
+	visit = func(n string) bool {
+		color[n] = visiting
+		stack = append(stack, n)
+		deps := append([]string{}, w.DepMap[n]...)
+		sort.Strings(deps)
+		for _, d := range deps {
+			if color[d] == visiting {
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == d {
+						cycle = append(append([]string{}, stack[i:]...), d)
+						break
 					}
-					wf.AddDepends(p, s)
+				}
+				return true
+			}
+			if color[d] == unvisited && visit(d) {
+				return true
+			}
+		}
+		stack = stack[:len(stack)-1]
+		color[n] = done
+		return false
+	}
+	for _, n := range names {
+		if color[n] == unvisited && visit(n) {
+			break
+		}
+	}
+	if cycle == nil {
+		return nil
+	}
+	//the stack follows dependencies, so report it backwards, in the order
+	//data flows
+	path := []string{cycle[len(cycle)-1]}
+	for i := len(cycle) - 1; i > 0; i-- {
+		if f := w.edgeFile(cycle[i-1], cycle[i]); f != "" {
+			path = append(path, f)
+		}
+		path = append(path, cycle[i-1])
+	}
+	return fmt.Errorf("dependency cycle: %s", strings.Join(path, " -> "))
+}
+
+// edgeFile returns the file that makes step depend on dep, or an empty string
+// if the dependency was declared explicitly
+func (w *Workflow) edgeFile(step, dep string) string {
+	s, ok := w.Steps[step]
+	if !ok {
+		return ""
+	}
+	outputs := map[string]bool{}
+	if d, ok := w.Steps[dep]; ok {
+		for _, o := range d.GetOutputs() {
+			outputs[o.Abs()] = true
+		}
+	}
+	paths := []string{}
+	for _, i := range s.GetInputs() {
+		if outputs[i.Abs()] {
+			paths = append(paths, i.Abs())
+		}
+	}
+	if len(paths) == 0 {
+		return ""
+	}
+	sort.Strings(paths)
+	return paths[0]
+}
+
+// TargetSteps finds the steps that produce the target paths. Targets that
+// are plain input files resolve to their file check steps
+func (w *Workflow) TargetSteps(paths []string) ([]string, error) {
+	out := []string{}
+	existing := map[string]bool{}
+	for n := range w.Steps {
+		existing[n] = true
+	}
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, err
+		}
+		if s := w.producer(abs); s != nil {
+			out = append(out, s.GetName())
+		} else if rs, err := w.ruleStep(abs, 0); err != nil {
+			return nil, err
+		} else if rs != nil {
+			out = append(out, rs.GetName())
+		} else if _, ok := w.Steps[abs]; ok {
+			out = append(out, abs)
+		} else {
+			return nil, fmt.Errorf("no step produces target %s", abs)
+		}
+	}
+	if len(w.Steps) != len(existing) {
+		//steps created from rules get their explicit dependencies, like
+		//the steps of the plan
+		names := []string{}
+		for n := range w.Steps {
+			if !existing[n] {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			if ws, ok := w.Steps[n].(*WorkflowProcess); ok {
+				if err := w.connectAfter(ws); err != nil {
+					return nil, err
 				}
 			}
 		}
+		if err := w.CheckCycles(); err != nil {
+			return nil, err
+		}
 	}
+	return out, nil
+}
 
-	return wf, nil
+// Prune removes every step that is not one of the named steps or one of
+// their transitive dependencies
+func (w *Workflow) Prune(names []string) {
+	keep := map[string]bool{}
+	queue := append([]string{}, names...)
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if !keep[n] {
+			keep[n] = true
+			queue = append(queue, w.DepMap[n]...)
+		}
+	}
+	for n := range w.Steps {
+		if !keep[n] {
+			delete(w.Steps, n)
+			delete(w.DepMap, n)
+			delete(w.AfterMap, n)
+		}
+	}
+	for path, s := range w.OutFileMap {
+		if !keep[s.GetName()] {
+			delete(w.OutFileMap, path)
+		}
+	}
+	logger.Info("Pruned workflow", "targets", names, "steps", len(w.Steps))
+}
+
+// ForceSteps marks the process steps whose names match the patterns (names or
+// globs) to be rerun. With downstream set, every step that depends on them
+// is forced as well
+func (w *Workflow) ForceSteps(patterns []string, downstream bool) error {
+	if w.Force == nil {
+		w.Force = map[string]bool{}
+	}
+	queue := []string{}
+	for _, pat := range patterns {
+		found := false
+		for n, s := range w.Steps {
+			if _, ok := s.(*WorkflowProcess); !ok {
+				continue
+			}
+			m, err := matchName(pat, n)
+			if err != nil {
+				return fmt.Errorf("bad force pattern %s: %s", pat, err)
+			}
+			if m {
+				found = true
+				queue = append(queue, n)
+			}
+		}
+		if !found {
+			return fmt.Errorf("no step to run matches %s", pat)
+		}
+	}
+	if !downstream {
+		for _, n := range queue {
+			w.Force[n] = true
+		}
+		return nil
+	}
+	for n := range w.downstreamOf(queue) {
+		w.Force[n] = true
+	}
+	return nil
+}
+
+// RunFrom reruns the named step and everything downstream of it. All other
+// steps are assumed to be up to date as long as their outputs exist
+func (w *Workflow) RunFrom(name string) error {
+	if _, ok := w.Steps[name].(*WorkflowProcess); !ok {
+		return fmt.Errorf("step %s not found", name)
+	}
+	if err := w.ForceSteps([]string{name}, true); err != nil {
+		return err
+	}
+	if w.Assume == nil {
+		w.Assume = map[string]bool{}
+	}
+	down := w.downstreamOf([]string{name})
+	for n := range w.Steps {
+		if !down[n] {
+			w.Assume[n] = true
+		}
+	}
+	return nil
+}
+
+// RunUntil removes every step that is not the named step or upstream of it
+func (w *Workflow) RunUntil(name string) error {
+	if _, ok := w.Steps[name].(*WorkflowProcess); !ok {
+		return fmt.Errorf("step %s not found", name)
+	}
+	w.Prune([]string{name})
+	return nil
+}
+
+// downstreamOf returns the named steps and every step that depends on them
+func (w *Workflow) downstreamOf(names []string) map[string]bool {
+	rdeps := map[string][]string{}
+	for n, deps := range w.DepMap {
+		for _, d := range deps {
+			rdeps[d] = append(rdeps[d], n)
+		}
+	}
+	out := map[string]bool{}
+	queue := append([]string{}, names...)
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		if !out[n] {
+			out[n] = true
+			queue = append(queue, rdeps[n]...)
+		}
+	}
+	return out
+}
+
+func (w *Workflow) dependsOn(stepName string, depName string) bool {
+	for _, d := range w.DepMap[stepName] {
+		if d == depName {
+			return true
+		}
+	}
+	return false
 }
 
 type FlameWorkflow struct {
@@ -140,9 +597,15 @@ type FlameWorkflow struct {
 	ProcessOut chan *WorkflowStatus
 }
 
-func (wf *Workflow) BuildFlame() (*FlameWorkflow, error) {
+// BuildFlame converts the DAG into a flame workflow. Once ctx is canceled,
+// no more steps are started and running commands are terminated
+func (wf *Workflow) BuildFlame(ctx context.Context) (*FlameWorkflow, error) {
 	logger.Info("Converting DAG to op-flow")
+	if err := wf.planTemps(); err != nil {
+		return nil, err
+	}
 	out := flame.NewWorkflow()
+	ctx, wf.cancel = context.WithCancel(ctx)
 
 	nodeMap := map[WorkflowStep]flame.Emitter[flame.KeyValue[string, *WorkflowStatus]]{}
 
@@ -152,11 +615,11 @@ func (wf *Workflow) BuildFlame() (*FlameWorkflow, error) {
 
 	//Connect elements that can run immediately with no dependencies to the root node
 	for _, v := range wf.Steps {
-		if v.IsGenerator() {
+		if v.IsGenerator() && len(wf.DepMap[v.GetName()]) == 0 {
 			curV := v
 			//fmt.Printf("Starting Node: %s %s\n", k, v.GetDesc())
 			m := flame.AddMapper(out, func(x *WorkflowStatus) flame.KeyValue[string, *WorkflowStatus] {
-				return curV.Process(x.Name, []*WorkflowStatus{x})
+				return curV.Process(ctx, x.Name, []*WorkflowStatus{x})
 			})
 			m.Connect(startNode)
 			nodeMap[v] = m
@@ -207,7 +670,7 @@ func (wf *Workflow) BuildFlame() (*FlameWorkflow, error) {
 					curV := v
 					//fmt.Printf("Found dependancy: %s\n", curV.GetDesc())
 					j := flame.AddKeyJoinGroupAsync(out, func(key string, status []*WorkflowStatus) *WorkflowStatus {
-						return curV.Process(key, status).Value
+						return curV.Process(ctx, key, status).Value
 					})
 					for _, i := range inNodes {
 						j.Connect(i)
@@ -219,10 +682,18 @@ func (wf *Workflow) BuildFlame() (*FlameWorkflow, error) {
 		}
 	}
 
+	missing := []string{}
 	for _, v := range wf.Steps {
 		if _, ok := nodeMap[v]; !ok {
-			logger.Info("Step not added to graph", "name", v.GetName())
+			missing = append(missing, v.GetName())
+		}
+	}
+	if len(missing) > 0 {
+		if err := wf.CheckCycles(); err != nil {
+			return nil, err
 		}
+		sort.Strings(missing)
+		return nil, fmt.Errorf("steps can not be scheduled: %s", strings.Join(missing, ", "))
 	}
 
 	return &FlameWorkflow{Workflow: out, ProcessIn: workChan}, nil
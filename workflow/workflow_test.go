@@ -0,0 +1,96 @@
+package workflow
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bmeg/lathe/scriptfile"
+)
+
+func testProcess(name string, inputs map[string]string, outputs map[string]string, after ...string) *scriptfile.ProcessDesc {
+	return &scriptfile.ProcessDesc{Name: name, BasePath: "/w", Inputs: inputs, Outputs: outputs, AfterNames: after}
+}
+
+func TestCheckCycles(t *testing.T) {
+	cases := []struct {
+		name  string
+		steps []*scriptfile.ProcessDesc
+		want  string
+	}{
+		{"no cycle", []*scriptfile.ProcessDesc{
+			testProcess("a", map[string]string{}, map[string]string{"o": "a.txt"}),
+			testProcess("b", map[string]string{"i": "a.txt"}, map[string]string{"o": "b.txt"}),
+		}, ""},
+		{"two steps", []*scriptfile.ProcessDesc{
+			testProcess("a", map[string]string{"i": "x.txt"}, map[string]string{"o": "y.txt"}),
+			testProcess("b", map[string]string{"i": "y.txt"}, map[string]string{"o": "x.txt"}),
+		}, "dependency cycle: a -> /w/y.txt -> b -> /w/x.txt -> a"},
+		{"three steps with a tail", []*scriptfile.ProcessDesc{
+			testProcess("a", map[string]string{"i": "c.txt"}, map[string]string{"o": "a.txt"}),
+			testProcess("b", map[string]string{"i": "a.txt"}, map[string]string{"o": "b.txt"}),
+			testProcess("c", map[string]string{"i": "b.txt"}, map[string]string{"o": "c.txt"}),
+			testProcess("d", map[string]string{"i": "c.txt"}, map[string]string{"o": "d.txt"}),
+		}, "dependency cycle: a -> /w/a.txt -> b -> /w/b.txt -> c -> /w/c.txt -> a"},
+		{"explicit dependencies", []*scriptfile.ProcessDesc{
+			testProcess("a", map[string]string{}, map[string]string{}, "b"),
+			testProcess("b", map[string]string{}, map[string]string{}, "a"),
+		}, "dependency cycle: a -> b -> a"},
+		{"mixed edges", []*scriptfile.ProcessDesc{
+			testProcess("a", map[string]string{}, map[string]string{"o": "a.txt"}, "b"),
+			testProcess("b", map[string]string{"i": "a.txt"}, map[string]string{}),
+		}, "dependency cycle: a -> /w/a.txt -> b -> a"},
+	}
+	for _, c := range cases {
+		wd := &scriptfile.WorkflowDesc{Name: c.name}
+		for _, s := range c.steps {
+			wd.Steps = append(wd.Steps, s)
+		}
+		_, err := PrepWorkflow(wd, nil)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestTargetRuleSteps(t *testing.T) {
+	dir := t.TempDir()
+	plan := filepath.Join(dir, "plan.js")
+	os.WriteFile(plan, []byte(`
+w = lathe.Workflow("w")
+w.Add(lathe.Process({name: "setup", commandLine: "true"}))
+w.Add(lathe.Rule({name: "convert", commandLine: "cp {{inputs.i}} {{outputs.o}}", inputs: {i: "in/{s}.txt"}, outputs: {o: "out/{s}.json"}, after: ["setup"]}))
+`), 0644)
+	pl, err := scriptfile.RunFile(plan, scriptfile.DefaultParams())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wf, err := PrepWorkflow(pl.Workflows["w"], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	steps, err := wf.TargetSteps([]string{filepath.Join(dir, "out/S1.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 1 || steps[0] != "convert:S1" {
+		t.Fatalf("target steps %v", steps)
+	}
+	if !wf.dependsOn("convert:S1", "setup") {
+		t.Errorf("rule step is missing its explicit dependency: %v", wf.DepMap["convert:S1"])
+	}
+	wf.Prune(steps)
+	if err := wf.ForceSteps([]string{"convert:*"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if !wf.Force["convert:S1"] {
+		t.Errorf("rule step was not forced")
+	}
+	if err := wf.ForceSteps([]string{"other"}, false); err == nil {
+		t.Errorf("expected an error for a pattern matching no step")
+	}
+}